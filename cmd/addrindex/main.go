@@ -0,0 +1,46 @@
+// Command addrindex converts the address CSV into the binary index mapped by the
+// watcher when ADDRESSES_INDEX is set.
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/ARK21/deblock/internal/app/users"
+)
+
+func main() {
+	in := flag.String("in", "./addresses.csv", "address CSV (address,user_id[,label[,tags]])")
+	out := flag.String("out", "./addresses.idx", "index file to write")
+	flag.Parse()
+
+	start := time.Now()
+	addrs, rep, err := users.ReadUsers(*in)
+	if err != nil {
+		log.Fatalf("read %s: %v", *in, err)
+	}
+	log.Printf("loaded %s: %s", *in, rep)
+	for _, p := range rep.Problems {
+		log.Print(p)
+	}
+
+	// write next to the target and rename, so a watcher never maps a half-written file
+	tmp := *out + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := filter.WriteIndex(f, addrs); err != nil {
+		log.Fatalf("write index: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Rename(tmp, *out); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %s: %d addresses in %s", *out, len(addrs), time.Since(start).Round(time.Millisecond))
+}
@@ -7,24 +7,34 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/ARK21/deblock/internal/app/admin"
 	"github.com/ARK21/deblock/internal/app/backfill"
-	"github.com/ARK21/deblock/internal/app/checkpoint"
 	"github.com/ARK21/deblock/internal/app/config"
 	"github.com/ARK21/deblock/internal/app/filter"
-	"github.com/ARK21/deblock/internal/app/heads"
 	"github.com/ARK21/deblock/internal/app/kafka"
 	"github.com/ARK21/deblock/internal/app/metrics"
-	"github.com/ARK21/deblock/internal/app/processor"
-	"github.com/ARK21/deblock/internal/app/reorg"
-	"github.com/ARK21/deblock/internal/app/rpc"
 	"github.com/ARK21/deblock/internal/app/users"
+	"github.com/ARK21/deblock/internal/app/watcher"
+	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			replay(os.Args[2:])
+			return
+		case "redrive":
+			redrive(os.Args[2:])
+			return
+		}
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -61,23 +71,20 @@ func main() {
 		}
 	}()
 
-	fs := checkpoint.NewFileStore(conf.CheckpointFile)
-	st, err := fs.Load(ctx)
+	addrs, fileSrc := addressSource(conf)
+	// blocks until the registry is complete, so no block is matched against a partial set
+	initial, err := addrs.Load(ctx)
 	if err != nil {
-		log.Fatalf("checkpoint load: %v", err)
+		log.Fatalf("load addresses: %v", err)
 	}
-	log.Printf("checkpoint: last_finalized=%d", st.LastFinalized)
-
-	u := users.LoadUsers(conf.AddressesFile)
-
-	matcher := filter.NewMatcher(u)
-
-	client, err := rpc.NewGethClient(ctx, conf.WsURL, conf.HttpUrl)
-	if err != nil {
-		log.Fatalf("rpc: %v", err)
+	matcher := filter.NewLive(initial)
+	go addrs.Watch(ctx, matcher)
+	if fileSrc != nil {
+		// with the Kafka registry the user service owns assignments
+		admin.Register(mux, users.Registry{Source: fileSrc, Live: matcher}, conf.AdminToken)
 	}
 
-	publisher, err := kafka.NewKafkaPublisher(conf.KafkaBrokers)
+	publisher, err := newPublisher(conf)
 	if err != nil {
 		log.Fatal("error creating kafka publisher:", err)
 	}
@@ -87,126 +94,101 @@ func main() {
 		log.Fatal("error creating event bus:", err)
 	}
 
-	chainID, err := client.GetChainID(ctx)
-	if err != nil {
-		log.Fatalf("get chain ID error: %v", err)
+	// a failing chain is reported unhealthy and restarted; the other chains keep running
+	var wg sync.WaitGroup
+	for _, chain := range conf.Chains {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runChain(ctx, chain, conf, matcher, bus)
+		}()
 	}
+	wg.Wait()
+	// keep serving /healthz and /metrics for halted chains until shutdown
+	<-ctx.Done()
+}
 
-	srv := processor.NewService(client, matcher, bus, chainID)
+// Bounds of the backoff between restarts of a failed chain.
+const (
+	chainRestartMin = 5 * time.Second
+	chainRestartMax = 5 * time.Minute
+)
 
-	finalizer := heads.NewFinalizer(conf.Confirmations)
-	reorgMgr := reorg.NewManager(conf.ReorgDepth)
+// runChain runs the pipeline of chain until ctx is done. A pipeline that fails,
+// to start or later, is reported unhealthy and started again after a backoff
+// doubling up to chainRestartMax. Only a deep-reorg halt stops the chain for
+// good, for the operator to resolve.
+func runChain(ctx context.Context, chain config.ChainConfig, conf config.Config, matcher filter.Provider, bus kafka.Publisher) {
+	m := metrics.ForChain(chain.Name)
+	backoff := chainRestartMin
+	for {
+		started := time.Now()
+		err := runPipeline(ctx, chain, conf, matcher, bus)
+		if ctx.Err() != nil {
+			return
+		}
+		if errors.Is(err, backfill.ErrNoAncestor) {
+			// the halt is already recorded in the chain's health
+			log.Printf("chain %s halted: %v", chain.Name, err)
+			return
+		}
+		if err == nil {
+			err = errors.New("heads stream ended")
+		}
+		m.Stopped(err)
+		if time.Since(started) > chainRestartMax {
+			// it ran fine for a while: this is a new failure
+			backoff = chainRestartMin
+		}
+		log.Printf("chain %s stopped: %v, restarting in %s", chain.Name, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff = min(2*backoff, chainRestartMax)
+	}
+}
 
-	head, err := client.GetBlockNumber(ctx)
+// runPipeline builds and runs one pipeline of chain, releasing its connections
+// and background work when it ends.
+func runPipeline(ctx context.Context, chain config.ChainConfig, conf config.Config, matcher filter.Provider, bus kafka.Publisher) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	p, err := watcher.NewPipeline(ctx, chain, conf, matcher, bus)
 	if err != nil {
-		log.Fatal("error getting block number:", err)
+		return err
 	}
-	var target uint64
-	if head >= uint64(conf.Confirmations) {
-		target = head - uint64(conf.Confirmations)
-	} else {
-		target = 0
+	defer p.Close()
+	p.Metrics.Restarted()
+	return p.Run(ctx)
+}
+
+// addressSource builds the configured address registry. fileSrc is set for the
+// file registry, which accepts changes through the admin API.
+func addressSource(conf config.Config) (addrs users.Source, fileSrc *users.FileSource) {
+	if conf.AddressSource == "kafka" {
+		return users.NewKafkaSource(conf.KafkaBrokers, conf.AddressesTopic), nil
 	}
+	fileSrc = users.NewFileSource(conf.AddressesFile, conf.AddressesReload)
+	fileSrc.Index = conf.AddressesIndex
+	fileSrc.Journal = users.NewJournal(conf.AddressesJournal)
+	return fileSrc, fileSrc
+}
 
-	// If first run with no checkpoint, optionally limit bootstrap depth
-	bootstrap := uint64(conf.BootstrapBlocks) // e.g., 0 (all) or 5000
-	start := st.LastFinalized + 1
-	if st.LastFinalized == 0 && bootstrap > 0 && target > bootstrap {
-		start = target - bootstrap + 1
+// newPublisher returns the event publisher: failed publishes are retried, then
+// parked on the dead-letter topic or, if Kafka is down, in the dead-letter file.
+func newPublisher(conf config.Config) (message.Publisher, error) {
+	pub, err := kafka.NewKafkaPublisher(conf.KafkaBrokers, conf.KafkaPartitionBy)
+	if err != nil {
+		return nil, err
 	}
-	if start <= target {
-		log.Printf("backfill: %d -> %d (target finalized)", start, target)
-		var lastSaved time.Time
-		save := func(n uint64) {
-			// throttle saves to disk (e.g., every 250ms)
-			if time.Since(lastSaved) < 250*time.Millisecond {
-				return
-			}
-		_:
-			fs.Save(ctx, checkpoint.State{LastFinalized: n, UpdatedAt: time.Now()})
-			lastSaved = time.Now()
-		}
-		if err := backfill.Run(ctx, client, srv, reorgMgr, start, target, save); err != nil {
-			log.Fatalf("backfill: %v", err)
-		}
-		// ensure final save
-		_ = fs.Save(ctx, checkpoint.State{LastFinalized: target, UpdatedAt: time.Now()})
-		log.Printf("backfill done up to %d", target)
-	} else {
-		log.Printf("no backfill needed (checkpoint at %d, target %d)", st.LastFinalized, target)
+	var dlq []kafka.DeadLetters
+	if conf.KafkaDLQTopic != "" {
+		dlq = append(dlq, &kafka.TopicDLQ{Publisher: pub, Topic: conf.KafkaDLQTopic})
 	}
-
-	src := heads.NewSource(client, conf.HeadPollInterval, conf.WSReconnectFloor, conf.WSReconnectCeil)
-
-	hch, ech := src.Run(ctx)
-	log.Printf("subscribed to newHeads (confs=%d)", conf.Confirmations)
-
-	for {
-		select {
-		case h, ok := <-hch:
-			if !ok {
-				log.Printf("heads channel closed: %v", hch)
-				return
-			}
-			header := heads.Header{
-				Hash:       h.Hash,
-				ParentHash: h.ParentHash,
-				Number:     h.Number,
-			}
-			log.Printf("handeling new head: %s (parent=%s, number=%d)", header.Hash, header.ParentHash, header.Number)
-			finalized := finalizer.Add(header)
-			for _, fh := range finalized {
-				// fetch the finalized block on the *current* canonical head
-				blk, err := client.GetBlockByNumber(ctx, fh.Number, true)
-				if err != nil {
-					log.Printf("get block by number %v: %v", fh.Number, err)
-					continue
-				}
-				if reorgMgr.ParentOK(blk) {
-					// normal path
-					matches, _ := srv.ProcessBlock(ctx, blk, false)
-					metrics.IncBlocksProcessed()
-					metrics.AddTxsMatched(matches)
-					metrics.SetFinalized(blk.Number)
-					reorgMgr.Record(blk)
-					_ = fs.Save(ctx, checkpoint.State{LastFinalized: blk.Number, UpdatedAt: time.Now()})
-					log.Printf("finalized block=%d txs=%d matches=%d", blk.Number, len(blk.Txs), matches)
-					continue
-				}
-
-				// reorg path
-				log.Printf("[REORG] parent mismatch at block %d (parent=%s)", blk.Number, blk.ParentHash)
-				ancNum, _, found := reorgMgr.CommonAncestor(ctx, client, blk.Hash, blk.Number)
-				if !found {
-					log.Printf("[REORG] ancestor not found within depth, skipping block %d for now", blk.Number)
-					// safe choice: skip until deeper heads arrive; or fall back to processing anyway
-					continue
-				}
-
-				// 1) Clear our local view for numbers > ancestor (drop stale mapping)
-				reorgMgr.ResetAbove(ancNum)
-				// 2) Re-process new canonical blocks from ancestor+1 up to current finalized number
-				metrics.IncReorg()
-				for n := ancNum + 1; n <= fh.Number; n++ {
-					nb, err := client.GetBlockByNumber(ctx, n, true)
-					if err != nil {
-						log.Printf("[REORG] fetch %d: %v", n, err)
-						break
-					}
-					matches, _ := srv.ProcessBlock(ctx, nb, true)
-					reorgMgr.Record(nb)
-					_ = fs.Save(ctx, checkpoint.State{LastFinalized: n, UpdatedAt: time.Now()})
-					metrics.IncReprocessed()
-					metrics.AddTxsMatched(matches)
-					metrics.SetFinalized(nb.Number)
-					log.Printf("[REORG] reprocessed block=%d matches=%d", nb.Number, matches)
-				}
-			}
-		case err := <-ech:
-			log.Printf("newHeads err: %v", err)
-		case <-ctx.Done():
-			log.Printf("shutdown")
-			return
-		}
+	if conf.DLQFile != "" {
+		dlq = append(dlq, &kafka.FileDLQ{Path: conf.DLQFile})
 	}
+	return kafka.NewRetryingPublisher(pub, conf.PublishRetryAttempts, conf.PublishRetryBackoff, dlq...), nil
 }
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/ARK21/deblock/internal/app/config"
+	"github.com/ARK21/deblock/internal/app/kafka"
+)
+
+// redrive publishes dead-lettered events again:
+//
+//	watcher redrive [--source file|topic] [--to topic]
+//
+// Events redriven from the file are removed from it unless they fail again.
+// The dead-letter topic is only read, so redriving it twice publishes its events
+// twice; consumers dedupe them by event ID.
+func redrive(args []string) {
+	fs := flag.NewFlagSet("redrive", flag.ExitOnError)
+	source := fs.String("source", "file", "where to read dead letters from: file (DLQ_FILE) or topic (KAFKA_DLQ_TOPIC)")
+	to := fs.String("to", "", "topic to publish to (default: the topic each event failed on)")
+	_ = fs.Parse(args)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	conf := config.Read()
+	pub, err := kafka.NewKafkaPublisher(conf.KafkaBrokers, conf.KafkaPartitionBy)
+	if err != nil {
+		log.Fatal("error creating kafka publisher:", err)
+	}
+	defer pub.Close()
+
+	switch *source {
+	case "file":
+		letters, err := kafka.ReadDeadLetterFile(conf.DLQFile)
+		if err != nil {
+			log.Fatalf("redrive: %v", err)
+		}
+		failed := kafka.Redrive(pub, letters, *to)
+		if len(letters) > 0 {
+			if err := kafka.WriteDeadLetterFile(conf.DLQFile, failed); err != nil {
+				log.Fatalf("redrive: rewrite %s: %v", conf.DLQFile, err)
+			}
+		}
+		log.Printf("redrive: %d of %d events from %s redriven", len(letters)-len(failed), len(letters), conf.DLQFile)
+	case "topic":
+		if conf.KafkaDLQTopic == "" {
+			log.Fatal("redrive: KAFKA_DLQ_TOPIC is empty")
+		}
+		letters, err := kafka.ReadDeadLetterTopic(ctx, conf.KafkaBrokers, conf.KafkaDLQTopic)
+		if err != nil {
+			log.Fatalf("redrive: %v", err)
+		}
+		failed := kafka.Redrive(pub, letters, *to)
+		log.Printf("redrive: %d of %d events from %s redriven", len(letters)-len(failed), len(letters), conf.KafkaDLQTopic)
+	default:
+		fmt.Fprintf(os.Stderr, "redrive: unknown source %q\n", *source)
+		fs.Usage()
+		os.Exit(2)
+	}
+}
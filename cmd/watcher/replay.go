@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/ARK21/deblock/internal/app/backfill"
+	"github.com/ARK21/deblock/internal/app/config"
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/ARK21/deblock/internal/app/kafka"
+	"github.com/ARK21/deblock/internal/app/users"
+	"github.com/ARK21/deblock/internal/app/watcher"
+)
+
+// replay re-emits the events of a block range:
+//
+//	watcher replay --from N [--to M] [--chain name] [--users file] [--topic t] [--dry-run]
+//
+// It uses the regular watcher configuration but never reads or writes the checkpoint.
+// Without --to it replays up to the last block final by the chain's finality.
+func replay(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	from := fs.Uint64("from", 0, "first block to replay (required)")
+	to := fs.Uint64("to", 0, "last block to replay (default: the last final block)")
+	chainName := fs.String("chain", "", "chain to replay (default: the first configured chain)")
+	usersFile := fs.String("users", "", "address file limiting the replay to its users (default: the configured registry)")
+	topic := fs.String("topic", "", "topic to publish to (default: KAFKA_TOPIC)")
+	dryRun := fs.Bool("dry-run", false, "print events as JSON lines instead of publishing them")
+	workers := fs.Int("workers", 0, "blocks fetched concurrently (default: BACKFILL_WORKERS)")
+	_ = fs.Parse(args)
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	// a missing --from would republish the chain from genesis; --from 0 does so on purpose
+	if !set["from"] || (set["to"] && *to < *from) {
+		fmt.Fprintln(os.Stderr, "replay: --from is required and --to must not be below it")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	conf := config.Read()
+	if *topic != "" {
+		conf.KafkaTopic = *topic
+	}
+	if *workers > 0 {
+		conf.BackfillWorkers = *workers
+	}
+
+	chain := conf.Chains[0]
+	if *chainName != "" {
+		found := false
+		for _, c := range conf.Chains {
+			if c.Name == *chainName {
+				chain, found = c, true
+			}
+		}
+		if !found {
+			log.Fatalf("replay: unknown chain %q", *chainName)
+		}
+	}
+
+	var matcher *filter.Matcher
+	if *usersFile != "" {
+		entries, report, err := users.ReadUsers(*usersFile)
+		if err != nil {
+			log.Fatalf("replay: read users: %v", err)
+		}
+		log.Printf("replay: users %s: %s", *usersFile, report)
+		matcher = filter.NewEntryMatcher(entries)
+	} else {
+		addrs, _ := addressSource(conf)
+		m, err := addrs.Load(ctx)
+		if err != nil {
+			log.Fatalf("replay: load addresses: %v", err)
+		}
+		matcher = m
+	}
+
+	var bus kafka.Publisher
+	if *dryRun {
+		bus = &printPublisher{enc: json.NewEncoder(os.Stdout)}
+	} else {
+		publisher, err := newPublisher(conf)
+		if err != nil {
+			log.Fatal("error creating kafka publisher:", err)
+		}
+		if bus, err = kafka.NewEventBus(publisher, conf.KafkaTopic); err != nil {
+			log.Fatal("error creating event bus:", err)
+		}
+	}
+
+	p, err := watcher.NewPipeline(ctx, chain, conf, matcher, bus)
+	if err != nil {
+		log.Fatalf("replay: chain %s: %v", chain.Name, err)
+	}
+	if !set["to"] {
+		_, target, err := p.Target(ctx)
+		if err != nil {
+			log.Fatalf("replay: chain %s: %v", chain.Name, err)
+		}
+		if target < *from {
+			log.Fatalf("replay: --from %d is above the last final block %d", *from, target)
+		}
+		*to = target
+	}
+	p.Probe(ctx, *to)
+
+	log.Printf("replay: chain %s blocks %d -> %d to %s (dry-run=%t)", chain.Name, *from, *to, conf.KafkaTopic, *dryRun)
+	// the live checkpoint is left alone: progress of a replay isn't saved anywhere
+	if err := backfill.Run(ctx, p.Client, p.Service, p.Reorg, *from, *to, conf.BackfillWorkers, func(uint64) {}); err != nil {
+		log.Fatalf("replay: %v", err)
+	}
+	log.Printf("replay: done")
+}
+
+// printPublisher writes events as JSON lines, for --dry-run.
+type printPublisher struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (p *printPublisher) Publish(_ context.Context, event any) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.enc.Encode(event)
+}
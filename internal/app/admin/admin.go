@@ -0,0 +1,113 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Registry is the live address set edited through the API.
+type Registry interface {
+	Add(addr string, e filter.Entry) error
+	Remove(addr string) error
+	Lookup(addr string) (filter.Entry, bool)
+}
+
+// maxBodyBytes bounds a request body; an address with its label and tags is far smaller.
+const maxBodyBytes = 64 << 10
+
+type addressBody struct {
+	Address string   `json:"address"`
+	UserID  string   `json:"user_id"`
+	Label   string   `json:"label,omitempty"`
+	Tags    []string `json:"tags,omitempty"`
+}
+
+// Register mounts the address endpoints on mux. Every request must carry
+// "Authorization: Bearer <token>"; an empty token leaves the API unmounted.
+func Register(mux *http.ServeMux, reg Registry, token string) {
+	if token == "" {
+		log.Printf("[admin] ADMIN_TOKEN not set, address API disabled")
+		return
+	}
+	auth := func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			// the scheme is case-insensitive; a bare token without it is rejected
+			scheme, got, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+			if !ok || !strings.EqualFold(scheme, "Bearer") ||
+				subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next(w, r)
+		}
+	}
+
+	mux.HandleFunc("POST /addresses", auth(func(w http.ResponseWriter, r *http.Request) {
+		var body addressBody
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodyBytes)).Decode(&body); err != nil {
+			status := http.StatusBadRequest
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			http.Error(w, "invalid body: "+err.Error(), status)
+			return
+		}
+		if !common.IsHexAddress(body.Address) || body.UserID == "" {
+			http.Error(w, "address and user_id are required", http.StatusBadRequest)
+			return
+		}
+		if err := reg.Add(body.Address, filter.Entry{UserID: body.UserID, Label: body.Label, Tags: body.Tags}); err != nil {
+			log.Printf("[admin] add %s: %v", body.Address, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body.Address = common.HexToAddress(body.Address).Hex()
+		writeJSON(w, http.StatusCreated, body)
+	}))
+
+	mux.HandleFunc("DELETE /addresses/{addr}", auth(func(w http.ResponseWriter, r *http.Request) {
+		addr := r.PathValue("addr")
+		if !common.IsHexAddress(addr) {
+			http.Error(w, "invalid address", http.StatusBadRequest)
+			return
+		}
+		if _, ok := reg.Lookup(addr); !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		if err := reg.Remove(addr); err != nil {
+			log.Printf("[admin] remove %s: %v", addr, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	mux.HandleFunc("GET /addresses/{addr}", auth(func(w http.ResponseWriter, r *http.Request) {
+		addr := r.PathValue("addr")
+		if !common.IsHexAddress(addr) {
+			http.Error(w, "invalid address", http.StatusBadRequest)
+			return
+		}
+		e, ok := reg.Lookup(addr)
+		if !ok {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, addressBody{Address: common.HexToAddress(addr).Hex(), UserID: e.UserID, Label: e.Label, Tags: e.Tags})
+	}))
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,92 @@
+package admin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/ARK21/deblock/internal/app/users"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddressAPI_PersistsAcrossRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "addresses.csv")
+	journalPath := filepath.Join(dir, "addresses.journal")
+	existing := "0x000000000000000000000000000000000000dEaD"
+	added := "0x000000000000000000000000000000000000bEEF"
+	require.NoError(t, os.WriteFile(csvPath, []byte("address,user_id\n"+existing+",u1\n"), 0o644))
+
+	boot := func() (*filter.Live, http.Handler) {
+		src := users.NewFileSource(csvPath, 0)
+		src.Journal = users.NewJournal(journalPath)
+		m, err := src.Load(ctx)
+		require.NoError(t, err)
+		live := filter.NewLive(m)
+		mux := http.NewServeMux()
+		Register(mux, users.Registry{Source: src, Live: live}, "secret")
+		return live, mux
+	}
+	do := func(h http.Handler, method, path, body, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	live, h := boot()
+	require.Equal(t, http.StatusUnauthorized, do(h, http.MethodPost, "/addresses", `{}`, "wrong").Code)
+	require.Equal(t, http.StatusBadRequest, do(h, http.MethodPost, "/addresses", `{"address":"nope","user_id":"u2"}`, "secret").Code)
+	huge := `{"address":"` + added + `","user_id":"u2","label":"` + strings.Repeat("x", maxBodyBytes) + `"}`
+	require.Equal(t, http.StatusRequestEntityTooLarge, do(h, http.MethodPost, "/addresses", huge, "secret").Code)
+
+	rec := do(h, http.MethodPost, "/addresses", `{"address":"`+added+`","user_id":"u2","label":"deposit","tags":["vip"]}`, "secret")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	uid, _, ok := live.Current().Match(added, nil)
+	require.True(t, ok)
+	require.Equal(t, "u2", uid)
+
+	require.Equal(t, http.StatusNoContent, do(h, http.MethodDelete, "/addresses/"+existing, "", "secret").Code)
+	require.Equal(t, http.StatusNotFound, do(h, http.MethodGet, "/addresses/"+existing, "", "secret").Code)
+
+	// a restart merges the journal with the CSV
+	live, h = boot()
+	rec = do(h, http.MethodGet, "/addresses/"+strings.ToLower(added), "", "secret")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), `"user_id":"u2","label":"deposit","tags":["vip"]`)
+	_, _, ok = live.Current().Match(existing, nil)
+	require.False(t, ok)
+}
+
+func TestAddressAPI_BearerScheme(t *testing.T) {
+	csvPath := filepath.Join(t.TempDir(), "addresses.csv")
+	require.NoError(t, os.WriteFile(csvPath, []byte("address,user_id\n"), 0o644))
+	src := users.NewFileSource(csvPath, 0)
+	m, err := src.Load(context.Background())
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	Register(mux, users.Registry{Source: src, Live: filter.NewLive(m)}, "secret")
+
+	for header, want := range map[string]int{
+		"Bearer secret": http.StatusNotFound,
+		"bearer secret": http.StatusNotFound,
+		"secret":        http.StatusUnauthorized,
+		"Basic secret":  http.StatusUnauthorized,
+		"Bearer ":       http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/addresses/0x000000000000000000000000000000000000dEaD", nil)
+		req.Header.Set("Authorization", header)
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		require.Equal(t, want, rec.Code, header)
+	}
+}
@@ -2,54 +2,367 @@ package backfill
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
+	"time"
 
+	"github.com/ARK21/deblock/internal/app/kafka"
 	"github.com/ARK21/deblock/internal/app/processor"
 	"github.com/ARK21/deblock/internal/app/reorg"
 	"github.com/ARK21/deblock/internal/app/rpc"
 )
 
+// Run backfills blocks from..to. Up to workers blocks are fetched and prepared
+// concurrently, but events are published, the reorg window recorded and save
+// called strictly in block order. A block whose events can't be delivered is
+// retried until they are, so save never skips past it.
 func Run(
 	ctx context.Context,
 	c rpc.Client,
 	proc *processor.Service,
 	mgr *reorg.Manager,
 	from, to uint64,
-	save func(uint65 uint64),
+	workers int,
+	save func(uint64),
 ) error {
 	if to < from {
 		return nil
 	}
+	if workers < 1 {
+		workers = 1
+	}
 
-	for n := from; n <= to; n++ {
-		log.Printf("backfill %d", n)
-		blk, err := c.GetBlockByNumber(ctx, n, true)
+	prog := &progress{proc: proc, from: from, to: to, start: time.Now()}
+	for n := from; n <= to; {
+		next, err := runWindow(ctx, c, proc, mgr, n, to, workers, save, prog)
 		if err != nil {
-			return fmt.Errorf("backfill get block %d: %w", n, err)
+			return err
 		}
+		n = next
+	}
+	return nil
+}
 
-		// Reorg safety even during backfill (rare, but safe)
-		if !mgr.ParentOK(blk) {
-			ancNum, _, ok := mgr.CommonAncestor(ctx, c, blk.Hash, blk.Number)
-			if !ok {
-				return fmt.Errorf("backfill: no ancestor within depth at %d", n)
+type result struct {
+	n    uint64
+	blk  rpc.Block
+	prep *processor.Prepared // nil if preparing failed; the block is prepared again on commit
+	err  error
+}
+
+// runWindow runs the pipeline from start until to or until a parent mismatch.
+// After a mismatch it replays the reorg and returns the block to resume from.
+func runWindow(
+	ctx context.Context,
+	c rpc.Client,
+	proc *processor.Service,
+	mgr *reorg.Manager,
+	start, to uint64,
+	workers int,
+	save func(uint64),
+	prog *progress,
+) (uint64, error) {
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// order carries one result channel per block, in block order; its buffer bounds the read-ahead
+	order := make(chan chan result, 2*workers)
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(order)
+		for n := start; n <= to; n++ {
+			ch := make(chan result, 1)
+			select {
+			case order <- ch:
+			case <-wctx.Done():
+				return
 			}
-			mgr.ResetAbove(ancNum)
-			for m := ancNum + 1; m <= n; m++ {
-				nb, err := c.GetBlockByNumber(ctx, m, true)
+			select {
+			case sem <- struct{}{}:
+			case <-wctx.Done():
+				ch <- result{n: n, err: wctx.Err()}
+				return
+			}
+			wg.Add(1)
+			go func(n uint64) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				blk, err := c.GetBlockByNumber(wctx, n, true)
 				if err != nil {
-					return err
+					ch <- result{n: n, err: fmt.Errorf("backfill get block %d: %w", n, err)}
+					return
+				}
+				prep, err := proc.Prepare(wctx, blk)
+				if err != nil && wctx.Err() == nil {
+					log.Printf("backfill prepare %d: %v", n, err)
 				}
-				_, _ = proc.ProcessBlock(ctx, nb, true)
-				mgr.Record(nb)
-				save(m)
+				ch <- result{n: n, blk: blk, prep: prep}
+			}(n)
+		}
+	}()
+	// stop the producer and workers before returning, whatever the outcome
+	defer wg.Wait()
+	defer cancel()
+
+	for ch := range order {
+		r := <-ch
+		if r.err != nil {
+			return 0, r.err
+		}
+		blk := r.blk
+
+		// Reorg safety even during backfill (rare, but safe)
+		if !mgr.ParentOK(blk) {
+			// everything prepared after this block may be on the stale fork
+			cancel()
+			if err := ReplayReorg(ctx, c, proc, mgr, blk, save); err != nil {
+				return 0, err
 			}
-			continue
+			prog.commit(blk.Number)
+			return blk.Number + 1, nil
+		}
+		log.Printf("backfill %d", blk.Number)
+		if _, err := proc.Deliver(ctx, blk, r.prep, false); err != nil {
+			return 0, err
 		}
-		_, _ = proc.ProcessBlock(ctx, blk, false)
 		mgr.Record(blk)
-		save(n)
+		save(blk.Number)
+		prog.commit(blk.Number)
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return to + 1, nil
+}
+
+// ErrNoAncestor means a reorg reaches below the reorg window and the chain was
+// halted by the deep-reorg policy.
+var ErrNoAncestor = errors.New("no common ancestor within reorg depth")
+
+// ReplayReorg handles a reorg whose new chain ends at blk. It announces the reorg,
+// re-processes the canonical blocks above the common ancestor, retracts the events
+// of orphaned blocks that didn't reappear and announces the outcome. save is called
+// for every re-processed block. A reorg deeper than the window is handled by
+// mgr.DeepPolicy and alerted with a DeepReorgEvent.
+func ReplayReorg(ctx context.Context, c rpc.Client, proc *processor.Service, mgr *reorg.Manager, blk rpc.Block, save func(uint64)) error {
+	ancNum, ancHash, ok := mgr.CommonAncestor(ctx, c, blk.Hash, blk.Number)
+	if !ok {
+		deep := &reorg.DeepReorg{BlockNumber: blk.Number, BlockHash: blk.Hash, Policy: mgr.DeepPolicy, At: time.Now().UTC()}
+		if mgr.DeepPolicy == reorg.PolicyWiden {
+			ancNum, ancHash, ok = mgr.CommonAncestorWithin(ctx, c, blk.Hash, blk.Number, mgr.MaxSearch)
+		}
+		switch {
+		case ok:
+			deep.Outcome, deep.AncestorNumber = "widened", ancNum
+		case mgr.DeepPolicy == reorg.PolicyResync:
+			deep.Outcome = "resynced"
+			deep.ResyncFrom = 1
+			if blk.Number > mgr.Depth() {
+				deep.ResyncFrom = blk.Number - mgr.Depth()
+			}
+		default:
+			deep.Outcome = "halted"
+		}
+		if err := alertDeepReorg(ctx, proc, mgr, deep); err != nil {
+			return err
+		}
+		switch deep.Outcome {
+		case "halted":
+			return fmt.Errorf("%w at %d", ErrNoAncestor, blk.Number)
+		case "resynced":
+			return resync(ctx, c, proc, mgr, deep.ResyncFrom, blk, save)
+		}
+	}
+
+	// fetch the new chain before dropping the local view of the old one
+	canonical, err := fetchChain(ctx, c, blk, ancNum+1)
+	if err != nil {
+		return fmt.Errorf("[REORG] %w", err)
+	}
+	if len(canonical) > 0 && canonical[0].ParentHash != ancHash {
+		return fmt.Errorf("[REORG] block %d doesn't extend ancestor %d (%s)", ancNum+1, ancNum, ancHash)
+	}
+	detected := kafka.ReorgDetectedEvent{
+		Header: kafka.NewEventHeader("ReorgDetectedEvent", kafka.EventKey{
+			ChainID: proc.ChainID, BlockHash: blk.Hash, Index: "ancestor:" + ancHash,
+		}),
+		ChainID:        proc.ChainID,
+		AncestorNumber: ancNum,
+		AncestorHash:   ancHash,
+		Depth:          mgr.Highest() - ancNum,
+	}
+	for n := ancNum + 1; n <= mgr.Highest(); n++ {
+		if h, ok := mgr.Hash(n); ok {
+			detected.OrphanedHashes = append(detected.OrphanedHashes, h)
+		}
+	}
+	for _, nb := range canonical {
+		detected.NewHashes = append(detected.NewHashes, nb.Hash)
+	}
+
+	// the orphaned events leave the window but are checkpointed with it until retracted
+	orphaned := mgr.ResetAbove(ancNum)
+	mgr.Orphan(orphaned, blk.Number)
+	detected.AffectedEvents = len(orphaned)
+	log.Printf("[REORG] chain %d: ancestor %d (%s), depth %d, %d events affected",
+		proc.ChainID, ancNum, ancHash, detected.Depth, detected.AffectedEvents)
+	if err := proc.Emit(ctx, detected); err != nil {
+		return err
+	}
+	proc.Metrics.IncReorg()
+
+	matched := 0
+	for _, nb := range canonical {
+		// the local view is already reset, so the replay can't stop half-way
+		m, err := proc.Deliver(ctx, nb, nil, true)
+		if err != nil {
+			return err
+		}
+		mgr.Record(nb)
+		save(nb.Number)
+		matched += m
+		proc.Metrics.IncReprocessed()
+		proc.Metrics.AddTxsMatched(m)
+		proc.Metrics.SetFinalized(nb.Number)
+		log.Printf("[REORG] reprocessed block=%d matches=%d", nb.Number, m)
+	}
+
+	// withdraw what the orphaned blocks published and the new chain doesn't have
+	retracted, err := FinishRetraction(ctx, proc, mgr)
+	if err != nil {
+		return err
+	}
+
+	return proc.Emit(ctx, kafka.ReorgResolvedEvent{
+		Header: kafka.NewEventHeader("ReorgResolvedEvent", kafka.EventKey{
+			ChainID: proc.ChainID, BlockHash: blk.Hash, Index: "ancestor:" + ancHash,
+		}),
+		ReorgID:        detected.Header.ID,
+		ChainID:        proc.ChainID,
+		AncestorNumber: ancNum,
+		NewHeadNumber:  blk.Number,
+		NewHeadHash:    blk.Hash,
+		Reprocessed:    len(canonical),
+		Matched:        matched,
+		Retracted:      retracted,
+	})
+}
+
+// FinishRetraction retracts the events of mgr.Retracting that the new chain
+// doesn't have, once it is re-processed through Retracting.Through, and returns
+// how many it retracted. Until the retraction goes out, the events stay pending.
+func FinishRetraction(ctx context.Context, proc *processor.Service, mgr *reorg.Manager) (int, error) {
+	r := mgr.Retracting
+	if r == nil || mgr.Highest() < r.Through {
+		return 0, nil
+	}
+	vanished := mgr.Vanished(r.Events)
+	if err := proc.Retract(ctx, vanished); err != nil {
+		return 0, err
+	}
+	mgr.Retracting = nil
+	log.Printf("[REORG] retracted %d events", len(vanished))
+	return len(vanished), nil
+}
+
+// alertDeepReorg records deep in mgr, which is checkpointed with the window, and
+// publishes it as a DeepReorgEvent.
+func alertDeepReorg(ctx context.Context, proc *processor.Service, mgr *reorg.Manager, deep *reorg.DeepReorg) error {
+	log.Printf("[REORG] chain %d: no ancestor of block %d within %d blocks, policy %s: %s",
+		proc.ChainID, deep.BlockNumber, mgr.Depth(), deep.Policy, deep.Outcome)
+	mgr.LastDeep = deep
+	proc.Metrics.DeepReorg(deep.Outcome)
+	return proc.Emit(ctx, kafka.DeepReorgEvent{
+		Header: kafka.NewEventHeader("DeepReorgEvent", kafka.EventKey{
+			ChainID: proc.ChainID, BlockHash: deep.BlockHash, Index: deep.Outcome,
+		}),
+		ChainID:        proc.ChainID,
+		BlockNumber:    deep.BlockNumber,
+		BlockHash:      deep.BlockHash,
+		Policy:         deep.Policy,
+		Outcome:        deep.Outcome,
+		AncestorNumber: deep.AncestorNumber,
+		ResyncFrom:     deep.ResyncFrom,
+	})
+}
+
+// resync drops the whole window and re-processes from..blk as reorged. Recorded events
+// from..blk that don't reappear are retracted; what was published below from stays as is.
+func resync(ctx context.Context, c rpc.Client, proc *processor.Service, mgr *reorg.Manager, from uint64, blk rpc.Block, save func(uint64)) error {
+	var orphaned []kafka.Emitted
+	for _, e := range mgr.ResetAbove(0) {
+		if e.BlockNumber >= from {
+			orphaned = append(orphaned, e)
+		}
+	}
+	mgr.Orphan(orphaned, blk.Number)
+	canonical, err := fetchChain(ctx, c, blk, from)
+	if err != nil {
+		return fmt.Errorf("[REORG] resync %w", err)
+	}
+	for _, nb := range canonical {
+		m, err := proc.Deliver(ctx, nb, nil, true)
+		if err != nil {
+			return err
+		}
+		mgr.Record(nb)
+		save(nb.Number)
+		proc.Metrics.IncReprocessed()
+		proc.Metrics.AddTxsMatched(m)
+		proc.Metrics.SetFinalized(nb.Number)
+	}
+	log.Printf("[REORG] resynced %d..%d", from, blk.Number)
+	_, err = FinishRetraction(ctx, proc, mgr)
+	return err
+}
+
+// fetchChain returns the blocks from..head.Number of head's chain, lowest first.
+// It follows parent hashes down from head rather than asking by number, so a
+// block the node has since replaced at some height can't slip in.
+func fetchChain(ctx context.Context, c rpc.Client, head rpc.Block, from uint64) ([]rpc.Block, error) {
+	if head.Number < from {
+		return nil, nil
+	}
+	out := make([]rpc.Block, head.Number-from+1)
+	hash := head.Hash
+	for i := len(out) - 1; i >= 0; i-- {
+		n := from + uint64(i)
+		nb, err := c.GetBlockByHash(ctx, hash, true)
+		if err != nil {
+			return nil, fmt.Errorf("fetch %d (%s): %w", n, hash, err)
+		}
+		if nb.Hash != hash || nb.Number != n {
+			return nil, fmt.Errorf("fetch %d (%s): got block %d (%s)", n, hash, nb.Number, nb.Hash)
+		}
+		out[i] = nb
+		hash = nb.ParentHash
+	}
+	return out, nil
+}
+
+// progress reports committed blocks, rate and ETA of a backfill.
+type progress struct {
+	proc      *processor.Service
+	from, to  uint64
+	start     time.Time
+	lastPrint time.Time
+}
+
+func (p *progress) commit(n uint64) {
+	done := n - p.from + 1
+	rate := float64(done) / time.Since(p.start).Seconds()
+	eta := time.Duration(0)
+	if rate > 0 {
+		eta = time.Duration(float64(p.to-n) / rate * float64(time.Second))
+	}
+	p.proc.Metrics.BackfillProgress(n, p.to, rate, eta)
+	if time.Since(p.lastPrint) >= 10*time.Second || n == p.to {
+		log.Printf("backfill progress: %d/%d blocks, %.1f blocks/s, eta %s", done, p.to-p.from+1, rate, eta.Round(time.Second))
+		p.lastPrint = time.Now()
 	}
-	return nil
 }
@@ -0,0 +1,358 @@
+package backfill
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/ARK21/deblock/internal/app/kafka"
+	"github.com/ARK21/deblock/internal/app/processor"
+	"github.com/ARK21/deblock/internal/app/reorg"
+	"github.com/ARK21/deblock/internal/app/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+const tracked = "0x0000000000000000000000000000000000000AaA"
+
+// chainRPC serves blocks 1..n with one tracked tx each, answering after a random delay
+// so concurrent fetches complete out of order.
+type chainRPC struct {
+	mu     sync.Mutex
+	blocks map[uint64]rpc.Block
+	byHash map[string]rpc.Block
+}
+
+func newChainRPC(n uint64, fork string) *chainRPC {
+	c := &chainRPC{blocks: map[uint64]rpc.Block{}, byHash: map[string]rpc.Block{}}
+	for i := uint64(1); i <= n; i++ {
+		c.put(i, fork)
+	}
+	return c
+}
+
+func (c *chainRPC) put(n uint64, fork string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	parent := fmt.Sprintf("H%d", n-1)
+	if p, ok := c.blocks[n-1]; ok {
+		parent = p.Hash
+	}
+	to := "0x0000000000000000000000000000000000000cCc"
+	b := rpc.Block{
+		Number:     n,
+		Hash:       fmt.Sprintf("H%d%s", n, fork),
+		ParentHash: parent,
+		Txs:        []rpc.Tx{{Hash: fmt.Sprintf("0xTX%d", n), From: tracked, To: &to, Value: "1"}},
+	}
+	c.blocks[n] = b
+	c.byHash[b.Hash] = b
+}
+
+func (c *chainRPC) SubscribeNewHeads(context.Context) (<-chan rpc.Header, <-chan error) {
+	return nil, nil
+}
+func (c *chainRPC) GetBlockByHash(_ context.Context, h string, _ bool) (rpc.Block, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.byHash[h], nil
+}
+func (c *chainRPC) GetBlockByNumber(_ context.Context, n uint64, _ bool) (rpc.Block, error) {
+	time.Sleep(time.Duration(rand.Intn(3)) * time.Millisecond)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.blocks[n], nil
+}
+func (c *chainRPC) GetBlockByTag(context.Context, string, bool) (rpc.Block, error) {
+	return rpc.Block{}, rpc.ErrNotFound
+}
+func (c *chainRPC) GetTxReceipt(context.Context, string) (rpc.Receipt, error) {
+	return rpc.Receipt{Status: 1}, nil
+}
+func (c *chainRPC) BatchGetReceipts(_ context.Context, hashes []string) (map[string]rpc.Receipt, error) {
+	out := make(map[string]rpc.Receipt, len(hashes))
+	for _, h := range hashes {
+		out[h] = rpc.Receipt{Status: 1}
+	}
+	return out, nil
+}
+func (c *chainRPC) GetBlockReceipts(context.Context, string) (map[string]rpc.Receipt, error) {
+	return nil, rpc.ErrBlockReceiptsUnavailable
+}
+func (c *chainRPC) TraceBlock(context.Context, uint64, string) ([]rpc.TraceFrame, error) {
+	return nil, rpc.ErrTracesUnavailable
+}
+func (c *chainRPC) GetChainID(context.Context) (uint64, error)     { return 1, nil }
+func (c *chainRPC) GetBlockNumber(context.Context) (uint64, error) { return 0, nil }
+
+type orderBus struct {
+	mu     sync.Mutex
+	blocks []uint64
+	reorg  []bool
+	// retracted holds the tx hashes of retractions
+	retracted []string
+	detected  []kafka.ReorgDetectedEvent
+	resolved  []kafka.ReorgResolvedEvent
+	deep      []kafka.DeepReorgEvent
+	// failAt fails the publishes of that block fails times
+	failAt uint64
+	fails  int
+	// stopAtRetract, if set, is called and fails the first retraction, like a
+	// shutdown mid-reorg
+	stopAtRetract context.CancelFunc
+}
+
+func (b *orderBus) Publish(_ context.Context, event any) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch e := event.(type) {
+	case kafka.TxRetractedEvent:
+		if b.stopAtRetract != nil {
+			b.stopAtRetract()
+			b.stopAtRetract = nil
+			return errors.New("broker down")
+		}
+		b.retracted = append(b.retracted, e.TxHash)
+		return nil
+	case kafka.ReorgDetectedEvent:
+		b.detected = append(b.detected, e)
+		return nil
+	case kafka.ReorgResolvedEvent:
+		b.resolved = append(b.resolved, e)
+		return nil
+	case kafka.DeepReorgEvent:
+		b.deep = append(b.deep, e)
+		return nil
+	}
+	e := event.(kafka.MatchedTxEvent)
+	if e.BlockNumber == b.failAt && b.fails > 0 {
+		b.fails--
+		return errors.New("broker down")
+	}
+	b.blocks = append(b.blocks, e.BlockNumber)
+	b.reorg = append(b.reorg, e.Reorged)
+	return nil
+}
+
+func TestRun_CommitsInOrder(t *testing.T) {
+	c := newChainRPC(100, "")
+	bus := &orderBus{}
+	proc := processor.NewService(c, filter.NewMatcher(map[string]string{tracked: "u"}), bus, 1)
+	mgr := reorg.NewManager(12)
+
+	var saved []uint64
+	err := Run(context.Background(), c, proc, mgr, 1, 100, 8, func(n uint64) { saved = append(saved, n) })
+	require.NoError(t, err)
+
+	require.Len(t, saved, 100)
+	require.Len(t, bus.blocks, 100)
+	for i := range saved {
+		require.Equal(t, uint64(i+1), saved[i])
+		require.Equal(t, uint64(i+1), bus.blocks[i])
+	}
+	require.Equal(t, uint64(100), mgr.Highest())
+}
+
+func TestRun_RetriesUndeliveredBlock(t *testing.T) {
+	c := newChainRPC(20, "")
+	bus := &orderBus{failAt: 7, fails: 2}
+	proc := processor.NewService(c, filter.NewMatcher(map[string]string{tracked: "u"}), bus, 1)
+	proc.DeliverBackoff = time.Millisecond
+	mgr := reorg.NewManager(12)
+
+	var saved []uint64
+	err := Run(context.Background(), c, proc, mgr, 1, 20, 4, func(n uint64) { saved = append(saved, n) })
+	require.NoError(t, err)
+
+	// block 7 is held back until delivered; nothing after it is published or saved before
+	require.Len(t, saved, 20)
+	require.Len(t, bus.blocks, 20)
+	for i := range saved {
+		require.Equal(t, uint64(i+1), saved[i])
+		require.Equal(t, uint64(i+1), bus.blocks[i])
+	}
+}
+
+func TestRun_ReplaysReorg(t *testing.T) {
+	c := newChainRPC(40, "")
+	bus := &orderBus{}
+	proc := processor.NewService(c, filter.NewMatcher(map[string]string{tracked: "u"}), bus, 1)
+	mgr := reorg.NewManager(12)
+
+	// blocks 1..20 were recorded on the old fork; the node now serves a new fork from 18
+	for n := uint64(1); n <= 20; n++ {
+		mgr.Record(c.blocks[n])
+	}
+	for n := uint64(18); n <= 40; n++ {
+		c.put(n, "b")
+	}
+
+	var saved []uint64
+	err := Run(context.Background(), c, proc, mgr, 21, 40, 4, func(n uint64) { saved = append(saved, n) })
+	require.NoError(t, err)
+
+	// 21 mismatches, 18..21 are replayed as reorged, then 22..40 continue normally
+	require.Equal(t, []uint64{18, 19, 20, 21}, saved[:4])
+	require.Equal(t, uint64(40), saved[len(saved)-1])
+	for i, n := range bus.blocks {
+		require.Equal(t, n <= 21, bus.reorg[i], "block %d", n)
+	}
+	require.True(t, mgr.ParentOK(rpc.Block{Number: 41, ParentHash: "H40b"}))
+
+	// the reorg is announced before and after reprocessing
+	require.Len(t, bus.detected, 1)
+	d := bus.detected[0]
+	require.Equal(t, uint64(17), d.AncestorNumber)
+	require.Equal(t, "H17", d.AncestorHash)
+	require.Equal(t, uint64(3), d.Depth)
+	require.Equal(t, []string{"H18", "H19", "H20"}, d.OrphanedHashes)
+	require.Equal(t, []string{"H18b", "H19b", "H20b", "H21b"}, d.NewHashes)
+	require.Len(t, bus.resolved, 1)
+	r := bus.resolved[0]
+	require.Equal(t, d.Header.ID, r.ReorgID)
+	require.Equal(t, "H21b", r.NewHeadHash)
+	require.Equal(t, 4, r.Reprocessed)
+}
+
+func TestRun_ReplayFollowsParentHashes(t *testing.T) {
+	c := newChainRPC(25, "")
+	bus := &orderBus{}
+	proc := processor.NewService(c, filter.NewMatcher(map[string]string{tracked: "u"}), bus, 1)
+	mgr := reorg.NewManager(12)
+	for n := uint64(1); n <= 20; n++ {
+		mgr.Record(c.blocks[n])
+	}
+	for n := uint64(18); n <= 25; n++ {
+		c.put(n, "b")
+	}
+	// by the time the replay fetches, the node answers 18..20 by number from yet another fork
+	b21 := c.blocks[21]
+	for n := uint64(18); n <= 20; n++ {
+		c.put(n, "c")
+	}
+	c.blocks[21] = b21
+
+	require.NoError(t, Run(context.Background(), c, proc, mgr, 21, 21, 1, func(uint64) {}))
+	require.Len(t, bus.detected, 1)
+	require.Equal(t, []string{"H18b", "H19b", "H20b", "H21b"}, bus.detected[0].NewHashes)
+	require.True(t, mgr.ParentOK(rpc.Block{Number: 22, ParentHash: "H21b"}))
+}
+
+func TestRun_RetractsOrphanedEvents(t *testing.T) {
+	c := newChainRPC(25, "")
+	bus := &orderBus{}
+	proc := processor.NewService(c, filter.NewMatcher(map[string]string{tracked: "u"}), bus, 1)
+	mgr := reorg.NewManager(12)
+	proc.OnDelivered = mgr.Remember
+
+	require.NoError(t, Run(context.Background(), c, proc, mgr, 1, 20, 4, func(uint64) {}))
+
+	// the new fork from 18 carries the txs of 18 and 20 again, but not the one of 19
+	for n := uint64(18); n <= 25; n++ {
+		c.put(n, "b")
+	}
+	c.blocks[19].Txs[0].Hash = "0xOTHER"
+
+	require.NoError(t, Run(context.Background(), c, proc, mgr, 21, 25, 4, func(uint64) {}))
+	require.Equal(t, []string{"0xTX19"}, bus.retracted)
+}
+
+func TestRun_PendingRetractionsSurviveFailure(t *testing.T) {
+	c := newChainRPC(25, "")
+	bus := &orderBus{}
+	proc := processor.NewService(c, filter.NewMatcher(map[string]string{tracked: "u"}), bus, 1)
+	mgr := reorg.NewManager(12)
+	proc.OnDelivered = mgr.Remember
+
+	require.NoError(t, Run(context.Background(), c, proc, mgr, 1, 20, 4, func(uint64) {}))
+	for n := uint64(18); n <= 25; n++ {
+		c.put(n, "b")
+	}
+	c.blocks[19].Txs[0].Hash = "0xOTHER"
+
+	// the new chain is checkpointed, but the watcher stops before the retraction
+	ctx, cancel := context.WithCancel(context.Background())
+	bus.stopAtRetract = cancel
+	require.Error(t, Run(ctx, c, proc, mgr, 21, 25, 4, func(uint64) {}))
+	require.NotNil(t, mgr.Retracting)
+	require.Equal(t, uint64(21), mgr.Retracting.Through)
+	require.Len(t, mgr.Retracting.Events, 3)
+
+	// after a restart from the checkpoint, the retraction is finished
+	restarted := reorg.NewManager(12)
+	restarted.Restore(mgr.Window())
+	restarted.Retracting = mgr.Retracting
+	n, err := FinishRetraction(context.Background(), proc, restarted)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, []string{"0xTX19"}, bus.retracted)
+	require.Nil(t, restarted.Retracting)
+}
+
+// deepFork delivers blocks 1..20 with a 4 block window, then forks the chain from 10.
+func deepFork(t *testing.T, policy string) (*chainRPC, *orderBus, *processor.Service, *reorg.Manager) {
+	c := newChainRPC(25, "")
+	bus := &orderBus{}
+	proc := processor.NewService(c, filter.NewMatcher(map[string]string{tracked: "u"}), bus, 1)
+	mgr := reorg.NewManager(4)
+	mgr.DeepPolicy = policy
+	mgr.MaxSearch = 16
+	proc.OnDelivered = mgr.Remember
+
+	require.NoError(t, Run(context.Background(), c, proc, mgr, 1, 20, 4, func(uint64) {}))
+	for n := uint64(10); n <= 25; n++ {
+		c.put(n, "b")
+	}
+	c.blocks[18].Txs[0].Hash = "0xOTHER"
+	return c, bus, proc, mgr
+}
+
+func TestRun_DeepReorgHalts(t *testing.T) {
+	c, bus, proc, mgr := deepFork(t, reorg.PolicyHalt)
+	bus.blocks = nil
+
+	var saved []uint64
+	err := Run(context.Background(), c, proc, mgr, 21, 25, 4, func(n uint64) { saved = append(saved, n) })
+	require.ErrorIs(t, err, ErrNoAncestor)
+
+	// nothing past the fork is published or checkpointed
+	require.Empty(t, saved)
+	require.Empty(t, bus.blocks)
+	require.Len(t, bus.deep, 1)
+	require.Equal(t, "halted", bus.deep[0].Outcome)
+	require.Equal(t, uint64(21), bus.deep[0].BlockNumber)
+	require.Equal(t, "halted", mgr.LastDeep.Outcome)
+}
+
+func TestRun_DeepReorgResyncs(t *testing.T) {
+	c, bus, proc, mgr := deepFork(t, reorg.PolicyResync)
+
+	var saved []uint64
+	require.NoError(t, Run(context.Background(), c, proc, mgr, 21, 25, 4, func(n uint64) { saved = append(saved, n) }))
+
+	// 21 - 4 onwards is re-processed; the tx of 18 is gone from the new chain
+	require.Equal(t, []uint64{17, 18, 19, 20, 21, 22, 23, 24, 25}, saved)
+	require.Len(t, bus.deep, 1)
+	require.Equal(t, "resynced", bus.deep[0].Outcome)
+	require.Equal(t, uint64(17), bus.deep[0].ResyncFrom)
+	require.Equal(t, []string{"0xTX18"}, bus.retracted)
+	require.True(t, mgr.ParentOK(rpc.Block{Number: 26, ParentHash: "H25b"}))
+}
+
+func TestRun_DeepReorgWidens(t *testing.T) {
+	c, bus, proc, mgr := deepFork(t, reorg.PolicyWiden)
+
+	var saved []uint64
+	require.NoError(t, Run(context.Background(), c, proc, mgr, 21, 25, 4, func(n uint64) { saved = append(saved, n) }))
+
+	// the kept hashes reach the ancestor at 9, so this is an ordinary reorg from there
+	require.Equal(t, uint64(10), saved[0])
+	require.Len(t, bus.deep, 1)
+	require.Equal(t, "widened", bus.deep[0].Outcome)
+	require.Equal(t, uint64(9), bus.deep[0].AncestorNumber)
+	require.Len(t, bus.resolved, 1)
+}
@@ -9,11 +9,21 @@ import (
 	"path/filepath"
 	"sync"
 	"time"
+
+	"github.com/ARK21/deblock/internal/app/reorg"
 )
 
 type State struct {
 	LastFinalized uint64    `json:"last_finalized"`
 	UpdatedAt     time.Time `json:"updated_at"`
+	// Window is the reorg window at LastFinalized, so a restart still notices
+	// a reorg of blocks it already published.
+	Window []reorg.Entry `json:"window,omitempty"`
+	// DeepReorg is the last reorg deeper than the window and how it was handled.
+	DeepReorg *reorg.DeepReorg `json:"deep_reorg,omitempty"`
+	// PendingRetractions are the orphaned events of a reorg replay that hasn't
+	// retracted them yet, so a crash mid-replay doesn't lose them.
+	PendingRetractions *reorg.Retraction `json:"pending_retractions,omitempty"`
 }
 
 type Store interface {
@@ -1,10 +1,13 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -13,25 +16,128 @@ type Config struct {
 	HttpUrl          string
 	KafkaBrokers     []string
 	KafkaTopic       string
+	KafkaPartitionBy string
 	Confirmations    int
 	ReorgDepth       int
+	Finality         string
+	BeaconURL        string
+	AddressSource    string
+	AddressesTopic   string
 	AddressesFile    string
+	AddressesIndex   string
+	AddressesReload  time.Duration
+	AddressesJournal string
+	AdminToken       string
 	HeadPollInterval time.Duration
 	WSReconnectFloor time.Duration
 	WSReconnectCeil  time.Duration
 	CheckpointFile   string
 	BootstrapBlocks  int
+	BackfillWorkers  int
 	HttpAddr         string
+	TrackTokens      bool
+	TraceMode        string
+	ChainsFile       string
+	Chains           []ChainConfig
+	RPCMaxLag        int
+	RPCQuarantine    time.Duration
+	// RPCBudgets is requests per second per RPC method and provider; "*" covers unlisted methods.
+	RPCBudgets map[string]float64
+	// Retry policy applied to every RPC method; see rpc.RetryPolicy.
+	RPCRetryAttempts   int
+	RPCRetryBackoff    time.Duration
+	RPCRetryMaxBackoff time.Duration
+	RPCCallTimeout     time.Duration
+	// Failed publishes are retried, then parked on the dead-letter topic, or in
+	// DLQFile when that fails too. An empty KafkaDLQTopic goes straight to the file.
+	PublishRetryAttempts int
+	PublishRetryBackoff  time.Duration
+	KafkaDLQTopic        string
+	DLQFile              string
+	// DeepReorgPolicy is what to do with a reorg deeper than the reorg depth: halt,
+	// resync or widen (search up to DeepReorgMaxDepth blocks back, then halt).
+	DeepReorgPolicy   string
+	DeepReorgMaxDepth int
+}
+
+// ChainConfig is one chain watched by the process. Zero values fall back to the
+// top-level settings, so a chains file only has to name what differs. Finality is
+// confirmations, finalized, safe or beacon (which needs BeaconURL).
+type ChainConfig struct {
+	Name            string `json:"name"`
+	WsURL           string `json:"ws_url"`
+	HttpUrl         string `json:"http_url"`
+	Confirmations   int    `json:"confirmations"`
+	ReorgDepth      int    `json:"reorg_depth"`
+	Finality        string `json:"finality"`
+	BeaconURL       string `json:"beacon_url"`
+	CheckpointFile  string `json:"checkpoint_file"`
+	BootstrapBlocks int    `json:"bootstrap_blocks"`
+	TraceMode       string `json:"trace_mode"`
+	// Providers lists the RPC endpoints to fail over between. Without it the
+	// chain has the single provider given by WsURL and HttpUrl.
+	Providers []ProviderConfig `json:"providers"`
+
+	// confsSet and bootstrapSet tell an explicit 0 in the chains file from unset
+	confsSet, bootstrapSet bool
+}
+
+func (c *ChainConfig) UnmarshalJSON(b []byte) error {
+	type plain ChainConfig
+	var aux struct {
+		plain
+		Confirmations   *int `json:"confirmations"`
+		BootstrapBlocks *int `json:"bootstrap_blocks"`
+	}
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	*c = ChainConfig(aux.plain)
+	if aux.Confirmations != nil {
+		c.Confirmations, c.confsSet = *aux.Confirmations, true
+	}
+	if aux.BootstrapBlocks != nil {
+		c.BootstrapBlocks, c.bootstrapSet = *aux.BootstrapBlocks, true
+	}
+	return nil
+}
+
+type ProviderConfig struct {
+	Name    string `json:"name"`
+	WsURL   string `json:"ws_url"`
+	HttpUrl string `json:"http_url"`
 }
 
 func Default() Config {
 	return Config{
 		KafkaTopic:       "tx_events",
+		KafkaPartitionBy: "user",
 		Confirmations:    3,
 		ReorgDepth:       12,
+		Finality:         "confirmations",
 		HeadPollInterval: 3 * time.Second,
 		WSReconnectFloor: 1 * time.Second,
 		WSReconnectCeil:  30 * time.Second,
+		TrackTokens:      true,
+		AddressesReload:  10 * time.Second,
+		BackfillWorkers:  8,
+		AddressSource:    "file",
+		AddressesTopic:   "address_registry",
+		RPCMaxLag:        3,
+		RPCQuarantine:    30 * time.Second,
+
+		RPCRetryAttempts:   5,
+		RPCRetryBackoff:    200 * time.Millisecond,
+		RPCRetryMaxBackoff: 5 * time.Second,
+		RPCCallTimeout:     10 * time.Second,
+
+		PublishRetryAttempts: 5,
+		PublishRetryBackoff:  200 * time.Millisecond,
+		KafkaDLQTopic:        "tx_events_dlq",
+		DLQFile:              "./data/dlq.jsonl",
+
+		DeepReorgPolicy:   "halt",
+		DeepReorgMaxDepth: 1024,
 	}
 }
 
@@ -48,11 +154,41 @@ func Read() Config {
 			cfg.ReorgDepth = reorgInt
 		}
 	}
+	if fin, ok := os.LookupEnv("FINALITY"); ok {
+		if !validFinality(fin) {
+			log.Fatalf("invalid FINALITY value: %q (want confirmations, finalized, safe or beacon)", fin)
+		}
+		cfg.Finality = fin
+	}
+	cfg.BeaconURL = os.Getenv("BEACON_URL")
 	if usersFile, exists := os.LookupEnv("ADDRESSES_FILE"); exists {
 		cfg.AddressesFile = usersFile
 	} else {
 		cfg.AddressesFile = "./addresses.csv"
 	}
+	cfg.AddressesIndex = os.Getenv("ADDRESSES_INDEX")
+	if as, ok := os.LookupEnv("ADDRESS_SOURCE"); ok {
+		switch as {
+		case "file", "kafka":
+			cfg.AddressSource = as
+		default:
+			log.Fatalf("invalid ADDRESS_SOURCE value: %q (want file or kafka)", as)
+		}
+	}
+	if at, ok := os.LookupEnv("ADDRESSES_TOPIC"); ok {
+		cfg.AddressesTopic = at
+	}
+	if ar, ok := os.LookupEnv("ADDRESSES_RELOAD_INTERVAL"); ok {
+		if d, err := time.ParseDuration(ar); err == nil {
+			cfg.AddressesReload = d
+		}
+	}
+	if aj, ok := os.LookupEnv("ADDRESSES_JOURNAL"); ok {
+		cfg.AddressesJournal = aj
+	} else {
+		cfg.AddressesJournal = "./data/addresses.journal"
+	}
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
 	if headPollInterval, ok := os.LookupEnv("HEAD_POLL_INTERVAL"); ok {
 		if hpi, err := time.ParseDuration(headPollInterval); err == nil {
 			cfg.HeadPollInterval = hpi
@@ -68,14 +204,89 @@ func Read() Config {
 			cfg.WSReconnectCeil = wrc
 		}
 	}
+	if ml, ok := os.LookupEnv("RPC_MAX_LAG"); ok {
+		if mlInt, err := strconv.Atoi(ml); err == nil {
+			cfg.RPCMaxLag = mlInt
+		} else {
+			log.Fatalf("invalid RPC_MAX_LAG value: %v", err)
+		}
+	}
+	if rq, ok := os.LookupEnv("RPC_QUARANTINE"); ok {
+		if d, err := time.ParseDuration(rq); err == nil {
+			cfg.RPCQuarantine = d
+		} else {
+			log.Fatalf("invalid RPC_QUARANTINE value: %v", err)
+		}
+	}
+	if rb, ok := os.LookupEnv("RPC_BUDGETS"); ok && rb != "" {
+		budgets, err := ParseBudgets(rb)
+		if err != nil {
+			log.Fatalf("invalid RPC_BUDGETS value: %v", err)
+		}
+		cfg.RPCBudgets = budgets
+	}
+	if ra, ok := os.LookupEnv("RPC_RETRY_ATTEMPTS"); ok {
+		if raInt, err := strconv.Atoi(ra); err == nil && raInt > 0 {
+			cfg.RPCRetryAttempts = raInt
+		} else {
+			log.Fatalf("invalid RPC_RETRY_ATTEMPTS value: %q", ra)
+		}
+	}
+	if pa, ok := os.LookupEnv("PUBLISH_RETRY_ATTEMPTS"); ok {
+		if paInt, err := strconv.Atoi(pa); err == nil && paInt > 0 {
+			cfg.PublishRetryAttempts = paInt
+		} else {
+			log.Fatalf("invalid PUBLISH_RETRY_ATTEMPTS value: %q", pa)
+		}
+	}
+	if dp, ok := os.LookupEnv("DEEP_REORG_POLICY"); ok {
+		switch dp {
+		case "halt", "resync", "widen":
+			cfg.DeepReorgPolicy = dp
+		default:
+			log.Fatalf("invalid DEEP_REORG_POLICY value: %q (want halt, resync or widen)", dp)
+		}
+	}
+	if dd, ok := os.LookupEnv("DEEP_REORG_MAX_DEPTH"); ok {
+		if ddInt, err := strconv.Atoi(dd); err == nil && ddInt > 0 {
+			cfg.DeepReorgMaxDepth = ddInt
+		} else {
+			log.Fatalf("invalid DEEP_REORG_MAX_DEPTH value: %q", dd)
+		}
+	}
+	if dt, ok := os.LookupEnv("KAFKA_DLQ_TOPIC"); ok {
+		cfg.KafkaDLQTopic = dt
+	}
+	if df, ok := os.LookupEnv("DLQ_FILE"); ok {
+		cfg.DLQFile = df
+	}
+	for env, dst := range map[string]*time.Duration{
+		"RPC_RETRY_BACKOFF":     &cfg.RPCRetryBackoff,
+		"RPC_RETRY_MAX_BACKOFF": &cfg.RPCRetryMaxBackoff,
+		"RPC_CALL_TIMEOUT":      &cfg.RPCCallTimeout,
+		"PUBLISH_RETRY_BACKOFF": &cfg.PublishRetryBackoff,
+	} {
+		if v, ok := os.LookupEnv(env); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				log.Fatalf("invalid %s value: %v", env, err)
+			}
+			// backoffs feed a jittered random wait, which needs a positive range
+			if d <= 0 && env != "RPC_CALL_TIMEOUT" {
+				log.Fatalf("invalid %s value: %q (must be positive)", env, v)
+			}
+			*dst = d
+		}
+	}
+	cfg.ChainsFile = os.Getenv("CHAINS_FILE")
 	if url, ok := os.LookupEnv("ETH_WS_URL"); ok {
 		cfg.WsURL = url
-	} else {
+	} else if cfg.ChainsFile == "" {
 		log.Fatal("ETH_WS_URL env variable not set")
 	}
 	if url, ok := os.LookupEnv("ETH_HTTP_URL"); ok {
 		cfg.HttpUrl = url
-	} else {
+	} else if cfg.ChainsFile == "" {
 		log.Fatal("ETH_HTTP_URL env variable not set")
 	}
 	if brokers, ok := os.LookupEnv("KAFKA_BROKERS"); ok {
@@ -86,6 +297,14 @@ func Read() Config {
 	if kt, ok := os.LookupEnv("KAFKA_TOPIC"); ok {
 		cfg.KafkaTopic = kt
 	}
+	if pb, ok := os.LookupEnv("KAFKA_PARTITION_BY"); ok {
+		switch pb {
+		case "user", "address", "chain_user":
+			cfg.KafkaPartitionBy = pb
+		default:
+			log.Fatalf("invalid KAFKA_PARTITION_BY value: %q (want user, address or chain_user)", pb)
+		}
+	}
 	if cf, ok := os.LookupEnv("CHECKPOINT_FILE"); ok {
 		cfg.CheckpointFile = cf
 	} else {
@@ -100,6 +319,13 @@ func Read() Config {
 	} else {
 		cfg.BootstrapBlocks = 0
 	}
+	if bw, ok := os.LookupEnv("BACKFILL_WORKERS"); ok {
+		if bwInt, err := strconv.Atoi(bw); err == nil && bwInt > 0 {
+			cfg.BackfillWorkers = bwInt
+		} else {
+			log.Fatalf("invalid BACKFILL_WORKERS value: %q", bw)
+		}
+	}
 	if port, ok := os.LookupEnv("SERVICE_PORT"); ok {
 		if _, err := strconv.Atoi(port); err == nil {
 			cfg.HttpAddr = ":" + port
@@ -109,20 +335,191 @@ func Read() Config {
 	} else {
 		cfg.HttpAddr = ":8080"
 	}
+	if tt, ok := os.LookupEnv("TRACK_TOKENS"); ok {
+		if b, err := strconv.ParseBool(tt); err == nil {
+			cfg.TrackTokens = b
+		} else {
+			log.Fatalf("invalid TRACK_TOKENS value: %v", err)
+		}
+	}
+	if tm, ok := os.LookupEnv("TRACE_MODE"); ok {
+		switch tm {
+		case "", "debug", "parity":
+			cfg.TraceMode = tm
+		default:
+			log.Fatalf("invalid TRACE_MODE value: %q (want debug, parity or empty)", tm)
+		}
+	}
+	if cfg.ChainsFile != "" {
+		chains, err := ReadChains(cfg.ChainsFile)
+		if err != nil {
+			log.Fatalf("invalid CHAINS_FILE: %v", err)
+		}
+		cfg.Chains = chains
+	} else {
+		name := os.Getenv("CHAIN_NAME")
+		if name == "" {
+			name = "ethereum"
+		}
+		cfg.Chains = []ChainConfig{{Name: name, WsURL: cfg.WsURL, HttpUrl: cfg.HttpUrl}}
+	}
+	for i := range cfg.Chains {
+		cfg.Chains[i] = cfg.withDefaults(cfg.Chains[i], len(cfg.Chains) > 1)
+	}
+
 	fmt.Printf("Watcher configs:\n")
 	fmt.Printf("ETH_WS_URL: %s\n", cfg.WsURL)
 	fmt.Printf("ETH_HTTP_URL: %s\n", cfg.HttpUrl)
 	fmt.Printf("KAFKA_BROKERS: %s\n", cfg.KafkaBrokers)
 	fmt.Printf("KAFKA_TOPIC: %s\n", cfg.KafkaTopic)
+	fmt.Printf("KAFKA_PARTITION_BY: %s\n", cfg.KafkaPartitionBy)
 	fmt.Printf("CONFIRMATIONS: %d\n", cfg.Confirmations)
 	fmt.Printf("REORG_DEPTH: %d\n", cfg.ReorgDepth)
+	fmt.Printf("FINALITY: %s\n", cfg.Finality)
+	fmt.Printf("BEACON_URL: %s\n", cfg.BeaconURL)
+	fmt.Printf("ADDRESS_SOURCE: %s\n", cfg.AddressSource)
+	fmt.Printf("ADDRESSES_TOPIC: %s\n", cfg.AddressesTopic)
 	fmt.Printf("ADDRESSES_FILE: %s\n", cfg.AddressesFile)
+	fmt.Printf("ADDRESSES_INDEX: %s\n", cfg.AddressesIndex)
+	fmt.Printf("ADDRESSES_RELOAD_INTERVAL: %s\n", cfg.AddressesReload)
+	fmt.Printf("ADDRESSES_JOURNAL: %s\n", cfg.AddressesJournal)
+	fmt.Printf("ADMIN_TOKEN set: %t\n", cfg.AdminToken != "")
 	fmt.Printf("HEAD_POLL_INTERVAL: %s\n", cfg.HeadPollInterval)
 	fmt.Printf("WS_RECONNECT_FLOOR: %s\n", cfg.WSReconnectFloor)
 	fmt.Printf("WS_RECONNECT_CEIL: %s\n", cfg.WSReconnectCeil)
 	fmt.Printf("CHECKPOINT_FILE: %s\n", cfg.CheckpointFile)
 	fmt.Printf("BOOTSTRAP_BLOCKS: %d\n", cfg.BootstrapBlocks)
+	fmt.Printf("BACKFILL_WORKERS: %d\n", cfg.BackfillWorkers)
 	fmt.Printf("SERVICE_PORT: %s\n", cfg.HttpAddr)
+	fmt.Printf("TRACK_TOKENS: %t\n", cfg.TrackTokens)
+	fmt.Printf("TRACE_MODE: %s\n", cfg.TraceMode)
+	fmt.Printf("RPC_MAX_LAG: %d\n", cfg.RPCMaxLag)
+	fmt.Printf("RPC_QUARANTINE: %s\n", cfg.RPCQuarantine)
+	fmt.Printf("RPC_BUDGETS: %v\n", cfg.RPCBudgets)
+	fmt.Printf("RPC_RETRY_ATTEMPTS: %d\n", cfg.RPCRetryAttempts)
+	fmt.Printf("RPC_RETRY_BACKOFF: %s\n", cfg.RPCRetryBackoff)
+	fmt.Printf("RPC_RETRY_MAX_BACKOFF: %s\n", cfg.RPCRetryMaxBackoff)
+	fmt.Printf("RPC_CALL_TIMEOUT: %s\n", cfg.RPCCallTimeout)
+	fmt.Printf("PUBLISH_RETRY_ATTEMPTS: %d\n", cfg.PublishRetryAttempts)
+	fmt.Printf("PUBLISH_RETRY_BACKOFF: %s\n", cfg.PublishRetryBackoff)
+	fmt.Printf("KAFKA_DLQ_TOPIC: %s\n", cfg.KafkaDLQTopic)
+	fmt.Printf("DLQ_FILE: %s\n", cfg.DLQFile)
+	fmt.Printf("DEEP_REORG_POLICY: %s\n", cfg.DeepReorgPolicy)
+	fmt.Printf("DEEP_REORG_MAX_DEPTH: %d\n", cfg.DeepReorgMaxDepth)
+	fmt.Printf("CHAINS_FILE: %s\n", cfg.ChainsFile)
+	for _, c := range cfg.Chains {
+		fmt.Printf("chain %s: finality=%s confirmations=%d reorg_depth=%d checkpoint=%s\n",
+			c.Name, c.Finality, c.Confirmations, c.ReorgDepth, c.CheckpointFile)
+		for _, p := range c.Providers {
+			fmt.Printf("chain %s provider %s: ws=%s http=%s\n", c.Name, p.Name, p.WsURL, p.HttpUrl)
+		}
+	}
 
 	return cfg
 }
+
+// ReadChains reads a JSON array of ChainConfig. Names must be set and unique;
+// they label metrics and checkpoint files.
+func ReadChains(file string) ([]ChainConfig, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var chains []ChainConfig
+	if err := json.Unmarshal(b, &chains); err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	if len(chains) == 0 {
+		return nil, fmt.Errorf("%s: no chains", file)
+	}
+	seen := make(map[string]bool, len(chains))
+	for _, c := range chains {
+		switch {
+		case c.Name == "":
+			return nil, fmt.Errorf("%s: chain without name", file)
+		case seen[c.Name]:
+			return nil, fmt.Errorf("%s: duplicate chain %q", file, c.Name)
+		case len(c.Providers) == 0 && (c.WsURL == "" || c.HttpUrl == ""):
+			return nil, fmt.Errorf("%s: chain %q needs ws_url and http_url, or providers", file, c.Name)
+		}
+		names := make(map[string]bool, len(c.Providers))
+		for _, p := range c.Providers {
+			switch {
+			case p.Name == "" || names[p.Name]:
+				return nil, fmt.Errorf("%s: chain %q: providers need unique names", file, c.Name)
+			case p.WsURL == "" || p.HttpUrl == "":
+				return nil, fmt.Errorf("%s: chain %q: provider %q needs ws_url and http_url", file, c.Name, p.Name)
+			}
+			names[p.Name] = true
+		}
+		switch c.TraceMode {
+		case "", "debug", "parity":
+		default:
+			return nil, fmt.Errorf("%s: chain %q: invalid trace_mode %q", file, c.Name, c.TraceMode)
+		}
+		if c.Finality != "" && !validFinality(c.Finality) {
+			return nil, fmt.Errorf("%s: chain %q: invalid finality %q", file, c.Name, c.Finality)
+		}
+		seen[c.Name] = true
+	}
+	return chains, nil
+}
+
+// withDefaults fills unset chain settings from cfg. With several chains the
+// default checkpoint file gets the chain name, so chains don't share progress.
+func (cfg Config) withDefaults(c ChainConfig, multi bool) ChainConfig {
+	if !c.confsSet {
+		c.Confirmations = cfg.Confirmations
+	}
+	if c.ReorgDepth == 0 {
+		c.ReorgDepth = cfg.ReorgDepth
+	}
+	if !c.bootstrapSet {
+		c.BootstrapBlocks = cfg.BootstrapBlocks
+	}
+	if c.Finality == "" {
+		c.Finality = cfg.Finality
+	}
+	if c.BeaconURL == "" {
+		c.BeaconURL = cfg.BeaconURL
+	}
+	if c.TraceMode == "" {
+		c.TraceMode = cfg.TraceMode
+	}
+	if len(c.Providers) == 0 {
+		c.Providers = []ProviderConfig{{Name: "primary", WsURL: c.WsURL, HttpUrl: c.HttpUrl}}
+	}
+	if c.CheckpointFile == "" {
+		c.CheckpointFile = cfg.CheckpointFile
+		if multi {
+			ext := filepath.Ext(c.CheckpointFile)
+			c.CheckpointFile = strings.TrimSuffix(c.CheckpointFile, ext) + "." + c.Name + ext
+		}
+	}
+	return c
+}
+
+func validFinality(f string) bool {
+	switch f {
+	case "confirmations", "finalized", "safe", "beacon":
+		return true
+	}
+	return false
+}
+
+// ParseBudgets parses "method=rate,..." such as "eth_getTransactionReceipt=100,*=25".
+func ParseBudgets(s string) (map[string]float64, error) {
+	out := make(map[string]float64)
+	for _, part := range strings.Split(s, ",") {
+		method, rate, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || method == "" {
+			return nil, fmt.Errorf("budget %q: want method=rate", part)
+		}
+		r, err := strconv.ParseFloat(rate, 64)
+		if err != nil || r <= 0 {
+			return nil, fmt.Errorf("budget %q: rate must be a positive number", part)
+		}
+		out[method] = r
+	}
+	return out, nil
+}
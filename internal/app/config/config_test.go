@@ -0,0 +1,65 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadChains_Defaults(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "chains.json")
+	require.NoError(t, os.WriteFile(file, []byte(`[
+		{"name": "ethereum", "ws_url": "wss://eth", "http_url": "https://eth"},
+		{"name": "base", "ws_url": "wss://base", "http_url": "https://base", "confirmations": 10, "reorg_depth": 64},
+		{"name": "dev", "ws_url": "wss://dev", "http_url": "https://dev", "confirmations": 0, "bootstrap_blocks": 0}
+	]`), 0o644))
+
+	chains, err := ReadChains(file)
+	require.NoError(t, err)
+	require.Len(t, chains, 3)
+
+	cfg := Default()
+	cfg.CheckpointFile = "./data/checkpoint.json"
+	cfg.BootstrapBlocks = 5000
+	eth, base := cfg.withDefaults(chains[0], true), cfg.withDefaults(chains[1], true)
+	// an explicit 0 isn't replaced by the default
+	dev := cfg.withDefaults(chains[2], true)
+	require.Equal(t, 0, dev.Confirmations)
+	require.Equal(t, 0, dev.BootstrapBlocks)
+	require.Equal(t, 5000, eth.BootstrapBlocks)
+	require.Equal(t, 3, eth.Confirmations)
+	require.Equal(t, 12, eth.ReorgDepth)
+	require.Equal(t, "data/checkpoint.ethereum.json", filepath.Clean(eth.CheckpointFile))
+	require.Equal(t, 10, base.Confirmations)
+	require.Equal(t, 64, base.ReorgDepth)
+	require.Equal(t, "data/checkpoint.base.json", filepath.Clean(base.CheckpointFile))
+}
+
+func TestReadChains_Invalid(t *testing.T) {
+	for name, body := range map[string]string{
+		"empty":     `[]`,
+		"no name":   `[{"ws_url": "wss://a", "http_url": "https://a"}]`,
+		"duplicate": `[{"name": "a", "ws_url": "wss://a", "http_url": "https://a"}, {"name": "a", "ws_url": "wss://b", "http_url": "https://b"}]`,
+		"no url":    `[{"name": "a", "ws_url": "wss://a"}]`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "chains.json")
+			require.NoError(t, os.WriteFile(file, []byte(body), 0o644))
+			_, err := ReadChains(file)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestParseBudgets(t *testing.T) {
+	b, err := ParseBudgets("eth_getTransactionReceipt=100, *=25.5")
+	require.NoError(t, err)
+	require.Equal(t, map[string]float64{"eth_getTransactionReceipt": 100, "*": 25.5}, b)
+
+	for _, bad := range []string{"eth_call", "=5", "eth_call=0", "eth_call=x"} {
+		_, err := ParseBudgets(bad)
+		require.Error(t, err, bad)
+	}
+}
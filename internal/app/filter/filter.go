@@ -1,34 +1,278 @@
 package filter
 
-import "github.com/ethereum/go-ethereum/common"
+import (
+	"iter"
+	"maps"
+	"slices"
+	"sync"
+	"sync/atomic"
 
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Provider returns the Matcher to use for the next block.
+type Provider interface {
+	Current() *Matcher
+}
+
+// Entry is the owner of a tracked address plus optional metadata from the address file.
+type Entry struct {
+	UserID string
+	Label  string
+	Tags   []string
+}
+
+func (e Entry) equal(o Entry) bool {
+	return e.UserID == o.UserID && e.Label == o.Label && slices.Equal(e.Tags, o.Tags)
+}
+
+// Matcher maps tracked addresses to user entries. It is safe for concurrent use,
+// so single addresses can be added or removed while blocks are matched.
+//
+// A Matcher either holds every address in a map, or sits on a compact Index
+// with the map as an overlay for runtime changes.
 type Matcher struct {
-	users map[common.Address]string
+	mu    sync.RWMutex
+	users map[common.Address]Entry
+	base  *Index
+	// removed hides base addresses; shadowed counts base addresses in users or removed.
+	removed  map[common.Address]struct{}
+	shadowed int
 }
 
+// NewMatcher builds a Matcher from address -> user ID.
 func NewMatcher(addrs map[string]string) *Matcher {
+	entries := make(map[string]Entry, len(addrs))
+	for a, uid := range addrs {
+		entries[a] = Entry{UserID: uid}
+	}
+	return NewEntryMatcher(entries)
+}
+
+// NewEntryMatcher builds a Matcher from address -> entry.
+func NewEntryMatcher(addrs map[string]Entry) *Matcher {
 	m := &Matcher{
-		users: make(map[common.Address]string, len(addrs)),
+		users: make(map[common.Address]Entry, len(addrs)),
 	}
-	for a, uid := range addrs {
+	for a, e := range addrs {
 		addr := common.HexToAddress(a)
-		m.users[addr] = uid
+		m.users[addr] = e
 	}
 
 	return m
 }
 
+// NewIndexMatcher builds a Matcher backed by idx.
+func NewIndexMatcher(idx *Index) *Matcher {
+	return &Matcher{
+		users:   make(map[common.Address]Entry),
+		base:    idx,
+		removed: make(map[common.Address]struct{}),
+	}
+}
+
+// Current makes a fixed Matcher usable as a Provider.
+func (m *Matcher) Current() *Matcher { return m }
+
+func (m *Matcher) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.base == nil {
+		return len(m.users)
+	}
+	return m.base.Len() + len(m.users) - m.shadowed
+}
+
+// Add tracks addr for e.UserID, replacing any previous owner.
+func (m *Matcher) Add(addr string, e Entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a := common.HexToAddress(addr)
+	if m.base != nil {
+		if _, inBase := m.base.Lookup(a); inBase {
+			_, over := m.users[a]
+			_, gone := m.removed[a]
+			if !over && !gone {
+				m.shadowed++
+			}
+			delete(m.removed, a)
+		}
+	}
+	m.users[a] = e
+}
+
+// Remove stops tracking addr and reports whether it was tracked.
+func (m *Matcher) Remove(addr string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	a := common.HexToAddress(addr)
+	_, ok := m.lookup(a)
+	_, over := m.users[a]
+	delete(m.users, a)
+	if m.base != nil && ok {
+		if _, inBase := m.base.Lookup(a); inBase {
+			if !over {
+				m.shadowed++
+			}
+			m.removed[a] = struct{}{}
+		}
+	}
+	return ok
+}
+
+// lookup must be called with mu held.
+func (m *Matcher) lookup(a common.Address) (Entry, bool) {
+	if e, ok := m.users[a]; ok {
+		return e, true
+	}
+	if m.base == nil {
+		return Entry{}, false
+	}
+	if _, gone := m.removed[a]; gone {
+		return Entry{}, false
+	}
+	return m.base.Lookup(a)
+}
+
+// Lookup returns the entry tracking addr.
+func (m *Matcher) Lookup(addr string) (Entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lookup(common.HexToAddress(addr))
+}
+
+// Match returns the user IDs owning from and to; empty when not tracked.
 func (m *Matcher) Match(from string, to *string) (string, string, bool) {
-	var fromUID, toUID string
+	fromE, toE, ok := m.MatchEntries(from, to)
+	return fromE.UserID, toE.UserID, ok
+}
+
+// MatchEntries is Match returning the full entries. It parses the hex addresses;
+// callers matching many txs should parse once and use MatchAddresses.
+func (m *Matcher) MatchEntries(from string, to *string) (Entry, Entry, bool) {
+	var fromA, toA *common.Address
 	if from != "" {
-		if iud, ok := m.users[common.HexToAddress(from)]; ok {
-			fromUID = iud
+		a := common.HexToAddress(from)
+		fromA = &a
+	}
+	if to != nil {
+		a := common.HexToAddress(*to)
+		toA = &a
+	}
+	return m.match(fromA, toA)
+}
+
+// MatchAddresses returns the entries owning from and to; to may be nil.
+func (m *Matcher) MatchAddresses(from common.Address, to *common.Address) (Entry, Entry, bool) {
+	return m.match(&from, to)
+}
+
+func (m *Matcher) match(from, to *common.Address) (Entry, Entry, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var fromE, toE Entry
+	if from != nil {
+		if e, ok := m.lookup(*from); ok {
+			fromE = e
 		}
 	}
 	if to != nil {
-		if iud, ok := m.users[common.HexToAddress(*to)]; ok {
-			toUID = iud
+		if e, ok := m.lookup(*to); ok {
+			toE = e
 		}
 	}
-	return fromUID, toUID, (fromUID != "" || toUID != "")
+	return fromE, toE, (fromE.UserID != "" || toE.UserID != "")
 }
+
+// all yields every tracked address in address order. An index is walked in place,
+// merged with the sorted overlay, so nothing the size of the index is allocated.
+func (m *Matcher) all() iter.Seq2[common.Address, Entry] {
+	return func(yield func(common.Address, Entry) bool) {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+		over := slices.SortedFunc(maps.Keys(m.users), common.Address.Cmp)
+		if m.base != nil {
+			for k := 0; k < m.base.count; k++ {
+				a := common.BytesToAddress(m.base.addrAt(k))
+				for len(over) > 0 && over[0].Cmp(a) < 0 {
+					if !yield(over[0], m.users[over[0]]) {
+						return
+					}
+					over = over[1:]
+				}
+				if len(over) > 0 && over[0] == a {
+					continue // yielded from the overlay
+				}
+				if _, gone := m.removed[a]; gone {
+					continue
+				}
+				if !yield(a, m.base.entryAt(k)) {
+					return
+				}
+			}
+		}
+		for _, a := range over {
+			if !yield(a, m.users[a]) {
+				return
+			}
+		}
+	}
+}
+
+// Diff counts addresses present in next but not in prev (added) and the other way round (removed).
+// Addresses whose entry changed count as both. Both matchers are walked in address order.
+func Diff(prev, next *Matcher) (added, removed int) {
+	pNext, pStop := iter.Pull2(prev.all())
+	defer pStop()
+	nNext, nStop := iter.Pull2(next.all())
+	defer nStop()
+
+	pa, pe, pok := pNext()
+	na, ne, nok := nNext()
+	for pok || nok {
+		switch c := cmpPos(pa, pok, na, nok); {
+		case c < 0:
+			removed++
+			pa, pe, pok = pNext()
+		case c > 0:
+			added++
+			na, ne, nok = nNext()
+		default:
+			if !pe.equal(ne) {
+				added++
+				removed++
+			}
+			pa, pe, pok = pNext()
+			na, ne, nok = nNext()
+		}
+	}
+	return added, removed
+}
+
+// cmpPos orders two positions of a merge walk; an exhausted side sorts last.
+func cmpPos(a common.Address, aok bool, b common.Address, bok bool) int {
+	switch {
+	case !aok:
+		return 1
+	case !bok:
+		return -1
+	}
+	return a.Cmp(b)
+}
+
+// Live is a Provider whose Matcher can be replaced while blocks are being processed.
+// Callers take Current once per block, so a swap only takes effect between blocks.
+type Live struct {
+	cur atomic.Pointer[Matcher]
+}
+
+func NewLive(m *Matcher) *Live {
+	l := &Live{}
+	l.cur.Store(m)
+	return l
+}
+
+func (l *Live) Current() *Matcher { return l.cur.Load() }
+
+// Swap installs m and returns the previous Matcher.
+func (l *Live) Swap(m *Matcher) *Matcher { return l.cur.Swap(m) }
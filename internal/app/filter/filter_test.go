@@ -12,3 +12,31 @@ func TestMatch(t *testing.T) {
 	}
 	t.Logf("fromUID: %s, toUID: %s", fromUID, toUID)
 }
+
+func TestLive_SwapAndDiff(t *testing.T) {
+	a := "0x000000000000000000000000000000000000dEaD"
+	b := "0x000000000000000000000000000000000000bEEF"
+	c := "0x000000000000000000000000000000000000CafE"
+
+	old := NewMatcher(map[string]string{a: "u1", b: "u2"})
+	live := NewLive(old)
+	snapshot := live.Current()
+
+	next := NewMatcher(map[string]string{a: "u1", b: "u3", c: "u4"})
+	if prev := live.Swap(next); prev != old {
+		t.Fatal("swap should return the previous matcher")
+	}
+
+	// a snapshot taken before the swap keeps the old view
+	if _, _, ok := snapshot.Match(c, nil); ok {
+		t.Fatal("old snapshot must not see new addresses")
+	}
+	if uid, _, ok := live.Current().Match(c, nil); !ok || uid != "u4" {
+		t.Fatalf("expected new address after swap, got %q", uid)
+	}
+
+	added, removed := Diff(old, next)
+	if added != 2 || removed != 1 {
+		t.Fatalf("want added=2 removed=1, got added=%d removed=%d", added, removed)
+	}
+}
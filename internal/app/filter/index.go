@@ -0,0 +1,256 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Index file layout (little-endian):
+//
+//	magic     [8]byte  "DBLKIDX1"
+//	count     uint64   number of addresses
+//	entries   uint64   number of distinct entries (user handles)
+//	bloomBits uint64
+//	bloomK    uint64
+//	addresses count * 20 bytes, sorted
+//	handles   count * uint32, entry handle of each address
+//	offsets   (entries+1) * uint64, into the entry blob
+//	bloom     bloomBits/8 bytes
+//	blob      entries encoded as user_id \x00 label \x00 tags joined by ';'
+const (
+	indexMagic      = "DBLKIDX1"
+	indexHeaderSize = 8 + 4*8
+	bloomBitsPerKey = 10
+	bloomK          = 7
+)
+
+// Index is a read-only, sorted address index, usually memory-mapped from a file
+// built by WriteIndex. Addresses refer to entries by integer handle, so each user
+// is stored once however many addresses they own.
+type Index struct {
+	data      []byte
+	count     int
+	entries   int
+	addrs     []byte
+	handles   []byte
+	offsets   []byte
+	bloom     []byte
+	bloomBits uint64
+	bloomK    uint64
+	blob      []byte
+	unmap     func() error
+}
+
+// OpenIndex maps the index file at path. The mapping is released once the Index is unreachable.
+func OpenIndex(path string) (*Index, error) {
+	data, unmap, err := mapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx, err := parseIndex(data)
+	if err != nil {
+		_ = unmap()
+		return nil, fmt.Errorf("index %s: %w", path, err)
+	}
+	idx.unmap = unmap
+	runtime.SetFinalizer(idx, func(i *Index) { _ = i.unmap() })
+	return idx, nil
+}
+
+func parseIndex(data []byte) (*Index, error) {
+	if len(data) < indexHeaderSize || string(data[:8]) != indexMagic {
+		return nil, errors.New("not an address index")
+	}
+	le := binary.LittleEndian
+	count, entries := le.Uint64(data[8:]), le.Uint64(data[16:])
+	bloomBits, k := le.Uint64(data[24:]), le.Uint64(data[32:])
+	if count > math.MaxUint32 || entries > count || bloomBits%8 != 0 {
+		return nil, errors.New("corrupt header")
+	}
+
+	idx := &Index{data: data, count: int(count), entries: int(entries), bloomBits: bloomBits, bloomK: k}
+	off := uint64(indexHeaderSize)
+	take := func(n uint64) ([]byte, error) {
+		if n > uint64(len(data))-off {
+			return nil, errors.New("truncated")
+		}
+		b := data[off : off+n]
+		off += n
+		return b, nil
+	}
+	var err error
+	if idx.addrs, err = take(count * common.AddressLength); err != nil {
+		return nil, err
+	}
+	if idx.handles, err = take(count * 4); err != nil {
+		return nil, err
+	}
+	if idx.offsets, err = take((entries + 1) * 8); err != nil {
+		return nil, err
+	}
+	if idx.bloom, err = take(bloomBits / 8); err != nil {
+		return nil, err
+	}
+	idx.blob = data[off:]
+	// a bad handle would only show up on lookup, so check them all now
+	for k := 0; k < idx.count; k++ {
+		if h := le.Uint32(idx.handles[k*4:]); uint64(h) >= entries {
+			return nil, fmt.Errorf("address %d refers to entry %d of %d", k, h, entries)
+		}
+	}
+	return idx, nil
+}
+
+func (i *Index) Len() int { return i.count }
+
+// Lookup returns the entry of a, checking the bloom filter before the binary search.
+func (i *Index) Lookup(a common.Address) (Entry, bool) {
+	if !i.mayContain(a) {
+		return Entry{}, false
+	}
+	n := sort.Search(i.count, func(k int) bool {
+		return bytes.Compare(i.addrAt(k), a[:]) >= 0
+	})
+	if n == i.count || !bytes.Equal(i.addrAt(n), a[:]) {
+		return Entry{}, false
+	}
+	return i.entryAt(n), true
+}
+
+func (i *Index) addrAt(k int) []byte {
+	return i.addrs[k*common.AddressLength : (k+1)*common.AddressLength]
+}
+
+func (i *Index) entry(h uint32) Entry {
+	le := binary.LittleEndian
+	start, end := le.Uint64(i.offsets[h*8:]), le.Uint64(i.offsets[(h+1)*8:])
+	if end > uint64(len(i.blob)) || start > end {
+		return Entry{}
+	}
+	return decodeEntry(i.blob[start:end])
+}
+
+// entryAt returns the entry of the k-th address.
+func (i *Index) entryAt(k int) Entry {
+	return i.entry(binary.LittleEndian.Uint32(i.handles[k*4:]))
+}
+
+func (i *Index) mayContain(a common.Address) bool {
+	if i.bloomBits == 0 {
+		return true
+	}
+	h1, h2 := bloomHashes(a)
+	for j := uint64(0); j < i.bloomK; j++ {
+		bit := (h1 + j*h2) % i.bloomBits
+		if i.bloom[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func bloomHashes(a common.Address) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write(a[:])
+	h1 := h.Sum64()
+	// splitmix64 finaliser for an independent second hash
+	h2 := h1 + 0x9e3779b97f4a7c15
+	h2 = (h2 ^ (h2 >> 30)) * 0xbf58476d1ce4e5b9
+	h2 = (h2 ^ (h2 >> 27)) * 0x94d049bb133111eb
+	h2 ^= h2 >> 31
+	return h1, h2 | 1
+}
+
+func encodeEntry(e Entry) []byte {
+	return []byte(e.UserID + "\x00" + e.Label + "\x00" + strings.Join(e.Tags, ";"))
+}
+
+func decodeEntry(b []byte) Entry {
+	parts := strings.SplitN(string(b), "\x00", 3)
+	e := Entry{UserID: parts[0]}
+	if len(parts) > 1 {
+		e.Label = parts[1]
+	}
+	if len(parts) > 2 && parts[2] != "" {
+		e.Tags = strings.Split(parts[2], ";")
+	}
+	return e
+}
+
+// WriteIndex writes addrs in the index format read by OpenIndex.
+func WriteIndex(w io.Writer, addrs map[string]Entry) error {
+	type row struct {
+		addr   common.Address
+		handle uint32
+	}
+	rows := make([]row, 0, len(addrs))
+	handles := make(map[string]uint32)
+	var blobs [][]byte
+	for a, e := range addrs {
+		enc := encodeEntry(e)
+		h, ok := handles[string(enc)]
+		if !ok {
+			h = uint32(len(blobs))
+			handles[string(enc)] = h
+			blobs = append(blobs, enc)
+		}
+		rows = append(rows, row{addr: common.HexToAddress(a), handle: h})
+	}
+	sort.Slice(rows, func(i, j int) bool { return bytes.Compare(rows[i].addr[:], rows[j].addr[:]) < 0 })
+	for i := 1; i < len(rows); i++ {
+		if rows[i].addr == rows[i-1].addr {
+			return fmt.Errorf("duplicate address %s", rows[i].addr.Hex())
+		}
+	}
+
+	bloomBits := uint64(len(rows)) * bloomBitsPerKey
+	bloomBits = (bloomBits + 63) / 64 * 64
+	bloom := make([]byte, bloomBits/8)
+	for _, r := range rows {
+		h1, h2 := bloomHashes(r.addr)
+		for j := uint64(0); j < bloomK; j++ {
+			bit := (h1 + j*h2) % bloomBits
+			bloom[bit/8] |= 1 << (bit % 8)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	le := binary.LittleEndian
+	var buf [8]byte
+	u64 := func(v uint64) { le.PutUint64(buf[:], v); bw.Write(buf[:8]) }
+
+	bw.WriteString(indexMagic)
+	u64(uint64(len(rows)))
+	u64(uint64(len(blobs)))
+	u64(bloomBits)
+	u64(bloomK)
+	for _, r := range rows {
+		bw.Write(r.addr[:])
+	}
+	for _, r := range rows {
+		le.PutUint32(buf[:], r.handle)
+		bw.Write(buf[:4])
+	}
+	off := uint64(0)
+	for _, b := range blobs {
+		u64(off)
+		off += uint64(len(b))
+	}
+	u64(off)
+	bw.Write(bloom)
+	for _, b := range blobs {
+		bw.Write(b)
+	}
+	return bw.Flush()
+}
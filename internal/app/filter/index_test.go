@@ -0,0 +1,135 @@
+package filter
+
+import (
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+func randomAddr(t *testing.T) string {
+	var b [20]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		t.Fatal(err)
+	}
+	return common.BytesToAddress(b[:]).Hex()
+}
+
+func TestIndexMatcher_SameResultsAsMap(t *testing.T) {
+	entries := make(map[string]Entry)
+	for i := 0; i < 5000; i++ {
+		// few users owning many addresses, so handles are shared
+		entries[randomAddr(t)] = Entry{UserID: []string{"u1", "u2", "u3"}[i%3], Label: "l", Tags: []string{"a", "b"}[:i%3]}
+	}
+	entries["0x000000000000000000000000000000000000dEaD"] = Entry{UserID: "u4"}
+
+	path := filepath.Join(t.TempDir(), "addresses.idx")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteIndex(f, entries); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	idx, err := OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact := NewIndexMatcher(idx)
+	plain := NewEntryMatcher(entries)
+	if compact.Len() != plain.Len() {
+		t.Fatalf("len: compact=%d map=%d", compact.Len(), plain.Len())
+	}
+
+	probe := make([]string, 0, len(entries)+1000)
+	for a := range entries {
+		probe = append(probe, a)
+	}
+	for i := 0; i < 1000; i++ {
+		probe = append(probe, randomAddr(t))
+	}
+	probe = append(probe, "0x000000000000000000000000000000000000dead", "")
+	for _, a := range probe {
+		to := a
+		wf, wt, wok := plain.MatchEntries(a, &to)
+		gf, gt, gok := compact.MatchEntries(a, &to)
+		if wok != gok || !wf.equal(gf) || !wt.equal(gt) {
+			t.Fatalf("%s: map=(%v %v %v) compact=(%v %v %v)", a, wf, wt, wok, gf, gt, gok)
+		}
+	}
+
+	// runtime changes on top of the index
+	dead := "0x000000000000000000000000000000000000dEaD"
+	extra := randomAddr(t)
+	if !compact.Remove(dead) || compact.Remove(dead) {
+		t.Fatal("remove should succeed once")
+	}
+	compact.Add(extra, Entry{UserID: "u5"})
+	compact.Add(dead, Entry{UserID: "u6"})
+	if uid, _, ok := compact.Match(dead, nil); !ok || uid != "u6" {
+		t.Fatalf("re-added address: got %q", uid)
+	}
+	if compact.Len() != plain.Len()+1 {
+		t.Fatalf("len after changes: %d", compact.Len())
+	}
+	if added, removed := Diff(plain, compact); added != 2 || removed != 1 {
+		t.Fatalf("diff: added=%d removed=%d", added, removed)
+	}
+}
+
+func writeIndexFile(t *testing.T, entries map[string]Entry) string {
+	path := filepath.Join(t.TempDir(), "addresses.idx")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteIndex(f, entries); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return path
+}
+
+func TestDiff_Indexes(t *testing.T) {
+	a, b, c := randomAddr(t), randomAddr(t), randomAddr(t)
+	prev, err := OpenIndex(writeIndexFile(t, map[string]Entry{a: {UserID: "u1"}, b: {UserID: "u2"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	next, err := OpenIndex(writeIndexFile(t, map[string]Entry{a: {UserID: "u1"}, b: {UserID: "u3"}, c: {UserID: "u4"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm, nm := NewIndexMatcher(prev), NewIndexMatcher(next)
+	if added, removed := Diff(pm, nm); added != 2 || removed != 1 {
+		t.Fatalf("diff: added=%d removed=%d", added, removed)
+	}
+
+	// overlay changes are merged into the walk
+	nm.Remove(c)
+	nm.Add(b, Entry{UserID: "u2"})
+	if added, removed := Diff(pm, nm); added != 0 || removed != 0 {
+		t.Fatalf("diff after overlay: added=%d removed=%d", added, removed)
+	}
+}
+
+func TestOpenIndex_BadHandle(t *testing.T) {
+	path := writeIndexFile(t, map[string]Entry{randomAddr(t): {UserID: "u1"}, randomAddr(t): {UserID: "u2"}})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the second address's handle points past the two entries
+	off := indexHeaderSize + 2*common.AddressLength + 4
+	copy(data[off:], []byte{0xff, 0xff, 0xff, 0xff})
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenIndex(path); err == nil {
+		t.Fatal("expected an error for an out of range handle")
+	}
+}
@@ -0,0 +1,103 @@
+package heads
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ARK21/deblock/internal/app/rpc"
+)
+
+// Finality decides which blocks are final.
+type Finality interface {
+	// Finalized returns the highest final block number while the head is at head.
+	Finalized(ctx context.Context, head uint64) (uint64, error)
+	Name() string
+}
+
+// Confirmations treats blocks N below the head as final.
+type Confirmations struct {
+	N uint64
+}
+
+func (c Confirmations) Name() string { return "confirmations" }
+
+func (c Confirmations) Finalized(_ context.Context, head uint64) (uint64, error) {
+	if head < c.N {
+		return 0, nil
+	}
+	return head - c.N, nil
+}
+
+// BlockTag asks the execution client for the block of Tag, "finalized" or "safe".
+type BlockTag struct {
+	Client rpc.Client
+	Tag    string
+}
+
+func (b BlockTag) Name() string { return b.Tag }
+
+func (b BlockTag) Finalized(ctx context.Context, _ uint64) (uint64, error) {
+	blk, err := b.Client.GetBlockByTag(ctx, b.Tag, false)
+	if err != nil {
+		return 0, fmt.Errorf("%s block: %w", b.Tag, err)
+	}
+	return blk.Number, nil
+}
+
+// Beacon reads the execution block of the finalized checkpoint from a beacon
+// node's REST API at URL.
+type Beacon struct {
+	URL  string
+	HTTP *http.Client
+}
+
+func (b Beacon) Name() string { return "beacon" }
+
+func (b Beacon) Finalized(ctx context.Context, _ uint64) (uint64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(b.URL, "/")+"/eth/v2/beacon/blocks/finalized", nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	hc := b.HTTP
+	if hc == nil {
+		hc = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("beacon finalized block: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("beacon finalized block: %s", resp.Status)
+	}
+
+	var body struct {
+		Data struct {
+			Message struct {
+				Body struct {
+					ExecutionPayload *struct {
+						BlockNumber string `json:"block_number"`
+					} `json:"execution_payload"`
+				} `json:"body"`
+			} `json:"message"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return 0, fmt.Errorf("beacon finalized block: %w", err)
+	}
+	payload := body.Data.Message.Body.ExecutionPayload
+	if payload == nil {
+		return 0, fmt.Errorf("beacon finalized block has no execution payload")
+	}
+	n, err := strconv.ParseUint(payload.BlockNumber, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("beacon finalized block number %q: %w", payload.BlockNumber, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,95 @@
+package heads
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ARK21/deblock/internal/app/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+// tagClient answers the finalized and safe tags with fixed blocks.
+type tagClient struct {
+	treeClient
+	tags map[string]uint64
+}
+
+func (c *tagClient) GetBlockByTag(_ context.Context, tag string, _ bool) (rpc.Block, error) {
+	n, ok := c.tags[tag]
+	if !ok {
+		return rpc.Block{}, rpc.ErrNotFound
+	}
+	return c.byNum[n], nil
+}
+
+func TestConfirmations(t *testing.T) {
+	n, err := Confirmations{N: 12}.Finalized(context.Background(), 100)
+	require.NoError(t, err)
+	require.Equal(t, uint64(88), n)
+
+	n, err = Confirmations{N: 12}.Finalized(context.Background(), 5)
+	require.NoError(t, err)
+	require.Zero(t, n)
+}
+
+func TestBlockTag(t *testing.T) {
+	c := &tagClient{treeClient: *newTreeClient(100), tags: map[string]uint64{"finalized": 64, "safe": 90}}
+
+	n, err := BlockTag{Client: c, Tag: "finalized"}.Finalized(context.Background(), 100)
+	require.NoError(t, err)
+	require.Equal(t, uint64(64), n)
+	n, err = BlockTag{Client: c, Tag: "safe"}.Finalized(context.Background(), 100)
+	require.NoError(t, err)
+	require.Equal(t, uint64(90), n)
+}
+
+func TestBeacon(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/eth/v2/beacon/blocks/finalized", r.URL.Path)
+		w.Write([]byte(`{"version":"deneb","finalized":true,"data":{"message":{"slot":"9000","body":{"execution_payload":{"block_number":"1234","block_hash":"0xabc"}}}}}`))
+	}))
+	defer srv.Close()
+
+	n, err := Beacon{URL: srv.URL + "/"}.Finalized(context.Background(), 2000)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1234), n)
+}
+
+func TestBeacon_Errors(t *testing.T) {
+	status := http.StatusOK
+	body := `{"data":{"message":{"body":{}}}}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	// a pre-merge block has no execution payload
+	_, err := Beacon{URL: srv.URL}.Finalized(context.Background(), 10)
+	require.ErrorContains(t, err, "no execution payload")
+
+	status = http.StatusServiceUnavailable
+	_, err = Beacon{URL: srv.URL}.Finalized(context.Background(), 10)
+	require.ErrorContains(t, err, "503")
+}
+
+func TestFinalizer_FollowsFinalizedTag(t *testing.T) {
+	c := &tagClient{treeClient: *newTreeClient(40), tags: map[string]uint64{"finalized": 8}}
+	f := NewFinalizer(c, BlockTag{Client: c, Tag: "finalized"})
+	f.Anchor(5, "H5")
+	ctx := context.Background()
+
+	out, err := f.Add(ctx, c.head(20))
+	require.NoError(t, err)
+	requireLinked(t, out, 6)
+	require.Len(t, out, 3)
+
+	// the tag moves on; the head hasn't, so nothing past it is finalized
+	c.tags["finalized"] = 30
+	out, err = f.Add(ctx, c.head(21))
+	require.NoError(t, err)
+	requireLinked(t, out, 9)
+	require.Equal(t, uint64(21), out[len(out)-1].Number)
+}
@@ -1,46 +1,146 @@
 package heads
 
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/ARK21/deblock/internal/app/metrics"
+	"github.com/ARK21/deblock/internal/app/rpc"
+)
+
 type Header struct {
 	Hash, ParentHash string
 	Number           uint64
 }
 
-// Finalizer buffers heads and emits them in order once they're N confirmations deep.
+// Finalizer keeps a tree of the heads seen above the last finalized one and emits
+// the branch of the newest head up to the block its Finality deems final. Sibling heads are
+// kept until the branch through them is settled, and missing or hash-less headers
+// (gaps, HTTP polling) are fetched from the client, so every finalized header
+// extends the one emitted before it.
 type Finalizer struct {
-	confs   uint64
-	latest  uint64
-	next    uint64
-	pending map[uint64]Header
+	Client   rpc.Client
+	Finality Finality
+	Metrics  *metrics.Chain
+
+	// tip is the newest head, taken as the node's canonical head
+	tip Header
+	// next is the number to finalize next and prev the hash it must extend ("" if unknown)
+	next     uint64
+	prev     string
+	anchored bool
+	nodes    map[string]Header
 }
 
-func NewFinalizer(confs int) *Finalizer {
+func NewFinalizer(c rpc.Client, fin Finality) *Finalizer {
 	return &Finalizer{
-		confs:   uint64(confs),
-		pending: make(map[uint64]Header),
+		Client:   c,
+		Finality: fin,
+		nodes:    make(map[string]Header),
 	}
 }
 
-func (f *Finalizer) Add(h Header) []Header {
-	f.pending[h.Number] = h
-	if h.Number > f.latest {
-		f.latest = h.Number
+// Anchor marks block n with hash as finalized, so the next emitted header is n+1
+// and extends hash. hash may be empty if it isn't known. Without an anchor the
+// first head added is the first to be finalized.
+func (f *Finalizer) Anchor(n uint64, hash string) {
+	f.next, f.prev, f.anchored = n+1, hash, true
+	f.prune()
+}
+
+// Add records head h and returns the headers it finalizes, lowest first. An error
+// means a header couldn't be fetched; nothing is lost and the next head retries.
+func (f *Finalizer) Add(ctx context.Context, h Header) ([]Header, error) {
+	if h.Hash == "" {
+		full, err := f.fetch(ctx, func() (rpc.Block, error) { return f.Client.GetBlockByNumber(ctx, h.Number, false) })
+		if err != nil {
+			return nil, fmt.Errorf("header %d: %w", h.Number, err)
+		}
+		h = full
+	}
+	if !f.anchored {
+		f.next, f.anchored = h.Number, true
+	}
+	if h.Number < f.next {
+		return nil, nil
+	}
+	f.nodes[h.Hash] = h
+	if f.tip.Hash == "" || h.Number >= f.tip.Number {
+		f.tip = h
+	}
+	final, err := f.Finality.Finalized(ctx, f.tip.Number)
+	if err != nil {
+		return nil, fmt.Errorf("%s finality: %w", f.Finality.Name(), err)
+	}
+	// never finalize past the branch we know
+	threshold := min(final, f.tip.Number)
+	f.Metrics.FinalityLag(f.Finality.Name(), f.tip.Number-threshold)
+	if threshold < f.next {
+		return nil, nil
+	}
+
+	// follow parent links from the tip down to next, filling in what's missing
+	cur := f.tip
+	branch := make([]Header, 0, threshold-f.next+1)
+	for cur.Number >= f.next {
+		if cur.Number <= threshold {
+			branch = append(branch, cur)
+		}
+		if cur.Number == f.next {
+			break
+		}
+		parent, ok := f.nodes[cur.ParentHash]
+		if !ok {
+			var err error
+			parent, err = f.fetch(ctx, func() (rpc.Block, error) { return f.Client.GetBlockByHash(ctx, cur.ParentHash, false) })
+			if err != nil {
+				return nil, fmt.Errorf("parent %s of %d: %w", cur.ParentHash, cur.Number, err)
+			}
+			f.nodes[parent.Hash] = parent
+		}
+		if parent.Number+1 != cur.Number {
+			return nil, fmt.Errorf("parent %s of %d has number %d", parent.Hash, cur.Number, parent.Number)
+		}
+		cur = parent
 	}
-	threshold := uint64(0)
-	if f.latest >= f.confs {
-		threshold = f.latest - f.confs
+	for i, j := 0, len(branch)-1; i < j; i, j = i+1, j-1 {
+		branch[i], branch[j] = branch[j], branch[i]
 	}
-	if f.next == 0 {
-		f.next = h.Number
+
+	if f.prev != "" && branch[0].ParentHash != f.prev {
+		// the reorg handling downstream sees the same parent mismatch
+		log.Printf("[heads] block %d (%s) doesn't extend finalized %s: reorg past %s finality",
+			branch[0].Number, branch[0].Hash, f.prev, f.Finality.Name())
 	}
+	f.next, f.prev = threshold+1, branch[len(branch)-1].Hash
+	f.prune()
+	return branch, nil
+}
 
-	finalized := make([]Header, 0)
+// fetch loads a header with get.
+func (f *Finalizer) fetch(ctx context.Context, get func() (rpc.Block, error)) (Header, error) {
+	if err := ctx.Err(); err != nil {
+		return Header{}, err
+	}
+	blk, err := get()
+	if err != nil {
+		return Header{}, err
+	}
+	if blk.Hash == "" {
+		return Header{}, rpc.ErrNotFound
+	}
+	return Header{Hash: blk.Hash, ParentHash: blk.ParentHash, Number: blk.Number}, nil
+}
 
-	for f.next != 0 && f.next <= threshold {
-		if hd, ok := f.pending[f.next]; ok {
-			finalized = append(finalized, hd)
-			delete(f.pending, f.next)
+// prune drops the headers below next; their branch is settled.
+func (f *Finalizer) prune() {
+	for hash, h := range f.nodes {
+		if h.Number < f.next {
+			delete(f.nodes, hash)
 		}
-		f.next++
 	}
-	return finalized
+	if f.tip.Number < f.next {
+		f.tip = Header{}
+	}
 }
@@ -1,17 +1,148 @@
 package heads
 
-import "testing"
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ARK21/deblock/internal/app/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+// treeClient serves headers of a chain 1..n whose blocks from a fork point may be
+// replaced by another branch.
+type treeClient struct {
+	fakeClient
+	byNum  map[uint64]rpc.Block
+	byHash map[string]rpc.Block
+}
+
+func newTreeClient(n uint64) *treeClient {
+	c := &treeClient{byNum: map[uint64]rpc.Block{}, byHash: map[string]rpc.Block{}}
+	c.fork(1, n, "")
+	return c
+}
+
+// fork replaces blocks from..to with branch b.
+func (c *treeClient) fork(from, to uint64, b string) {
+	for n := from; n <= to; n++ {
+		parent := fmt.Sprintf("H%d", n-1)
+		if p, ok := c.byNum[n-1]; ok {
+			parent = p.Hash
+		}
+		blk := rpc.Block{Number: n, Hash: fmt.Sprintf("H%d%s", n, b), ParentHash: parent}
+		c.byNum[n] = blk
+		c.byHash[blk.Hash] = blk
+	}
+}
+
+func (c *treeClient) head(n uint64) Header {
+	b := c.byNum[n]
+	return Header{Hash: b.Hash, ParentHash: b.ParentHash, Number: n}
+}
+
+func (c *treeClient) GetBlockByHash(_ context.Context, h string, _ bool) (rpc.Block, error) {
+	if b, ok := c.byHash[h]; ok {
+		return b, nil
+	}
+	return rpc.Block{}, rpc.ErrNotFound
+}
+
+func (c *treeClient) GetBlockByNumber(_ context.Context, n uint64, _ bool) (rpc.Block, error) {
+	if b, ok := c.byNum[n]; ok {
+		return b, nil
+	}
+	return rpc.Block{}, rpc.ErrNotFound
+}
+
+// requireLinked checks that out is contiguous from first and hash-linked.
+func requireLinked(t *testing.T, out []Header, first uint64) {
+	t.Helper()
+	for i, h := range out {
+		require.Equal(t, first+uint64(i), h.Number)
+		if i > 0 {
+			require.Equal(t, out[i-1].Hash, h.ParentHash, "block %d", h.Number)
+		}
+	}
+}
 
 func TestFinalizer_OrderAndConfs(t *testing.T) {
-	f := NewFinalizer(3)
+	c := newTreeClient(20)
+	f := NewFinalizer(c, Confirmations{N: 3})
 	var out []Header
 
 	for _, n := range []uint64{10, 11, 12, 13, 14} {
-		fs := f.Add(Header{Number: n})
+		fs, err := f.Add(context.Background(), c.head(n))
+		require.NoError(t, err)
 		out = append(out, fs...)
 	}
 	// With confs=3 we finalize 10 and 11 when we see 13 & 14.
-	if len(out) != 2 || out[0].Number != 10 || out[1].Number != 11 {
-		t.Fatalf("unexpected finalized: %#v", out)
+	require.Len(t, out, 2)
+	requireLinked(t, out, 10)
+}
+
+func TestFinalizer_KeepsSiblings(t *testing.T) {
+	c := newTreeClient(20)
+	f := NewFinalizer(c, Confirmations{N: 3})
+	f.Anchor(9, "H9")
+	ctx := context.Background()
+
+	var out []Header
+	for n := uint64(10); n <= 13; n++ {
+		fs, err := f.Add(ctx, c.head(n))
+		require.NoError(t, err)
+		out = append(out, fs...)
 	}
+	// a competing 12b arrives and the node follows it; 12 must not be finalized
+	old12 := c.head(12)
+	c.fork(12, 16, "b")
+	for n := uint64(12); n <= 16; n++ {
+		fs, err := f.Add(ctx, c.head(n))
+		require.NoError(t, err)
+		out = append(out, fs...)
+	}
+
+	require.Len(t, out, 4)
+	requireLinked(t, out, 10)
+	require.Equal(t, "H9", out[0].ParentHash)
+	require.Equal(t, "H12b", out[2].Hash)
+	require.NotEqual(t, old12.Hash, out[2].Hash)
+}
+
+func TestFinalizer_FillsGaps(t *testing.T) {
+	c := newTreeClient(40)
+	f := NewFinalizer(c, Confirmations{N: 2})
+	f.Anchor(5, "H5")
+	ctx := context.Background()
+
+	var out []Header
+	// hash-less polled heads with numbers skipped, then a head far ahead
+	for _, n := range []uint64{7, 8, 12, 30} {
+		fs, err := f.Add(ctx, Header{Number: n})
+		require.NoError(t, err)
+		out = append(out, fs...)
+	}
+
+	require.Len(t, out, 23)
+	requireLinked(t, out, 6)
+	require.Equal(t, "H5", out[0].ParentHash)
+	require.Equal(t, "H28", out[len(out)-1].Hash)
+}
+
+func TestFinalizer_RetriesAfterFetchError(t *testing.T) {
+	c := newTreeClient(20)
+	f := NewFinalizer(c, Confirmations{N: 2})
+	f.Anchor(5, "H5")
+	ctx := context.Background()
+
+	missing := c.byHash["H7"]
+	delete(c.byHash, "H7")
+	_, err := f.Add(ctx, c.head(10))
+	require.ErrorIs(t, err, rpc.ErrNotFound)
+
+	c.byHash["H7"] = missing
+	out, err := f.Add(ctx, c.head(11))
+	require.NoError(t, err)
+	require.Len(t, out, 4)
+	requireLinked(t, out, 6)
 }
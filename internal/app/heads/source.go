@@ -18,6 +18,7 @@ type Source struct {
 	PollInterval   time.Duration
 	ReconnectFloor time.Duration
 	ReconnectCeil  time.Duration
+	Metrics        *metrics.Chain
 }
 
 func NewSource(
@@ -61,7 +62,7 @@ func (s *Source) Run(ctx context.Context) (<-chan rpc.Header, <-chan error) {
 			heads, errors := s.Client.SubscribeNewHeads(ctx)
 			if heads != nil {
 				log.Printf("[heads] ws subscribed")
-				metrics.SetWSUp(true)
+				s.Metrics.SetWSUp(true)
 				// While WS OK, forward and reset backoff
 				for {
 					select {
@@ -71,7 +72,7 @@ func (s *Source) Run(ctx context.Context) (<-chan rpc.Header, <-chan error) {
 							break
 						}
 						if h.Number > last {
-							metrics.SetHead(h.Number)
+							s.Metrics.SetHead(h.Number)
 							out <- h
 							last = h.Number
 						}
@@ -89,7 +90,7 @@ func (s *Source) Run(ctx context.Context) (<-chan rpc.Header, <-chan error) {
 				}
 			}
 			log.Printf("[heads] fallback to HTTP polling every %s", poll)
-			metrics.SetWSUp(false)
+			s.Metrics.SetWSUp(false)
 			t := time.NewTicker(poll)
 			for {
 				select {
@@ -21,12 +21,21 @@ func (f *fakeClient) GetBlockByHash(context.Context, string, bool) (rpc.Block, e
 func (f *fakeClient) GetBlockByNumber(context.Context, uint64, bool) (rpc.Block, error) {
 	return rpc.Block{}, nil
 }
+func (f *fakeClient) GetBlockByTag(context.Context, string, bool) (rpc.Block, error) {
+	return rpc.Block{}, nil
+}
 func (f *fakeClient) GetTxReceipt(context.Context, string) (rpc.Receipt, error) {
 	return rpc.Receipt{}, nil
 }
 func (f *fakeClient) BatchGetReceipts(context.Context, []string) (map[string]rpc.Receipt, error) {
 	return nil, nil
 }
+func (f *fakeClient) GetBlockReceipts(context.Context, string) (map[string]rpc.Receipt, error) {
+	return nil, rpc.ErrBlockReceiptsUnavailable
+}
+func (f *fakeClient) TraceBlock(context.Context, uint64, string) ([]rpc.TraceFrame, error) {
+	return nil, rpc.ErrTracesUnavailable
+}
 func (f *fakeClient) GetChainID(context.Context) (uint64, error) { return 1, nil }
 func (f *fakeClient) GetBlockNumber(context.Context) (uint64, error) {
 	f.n++
@@ -3,6 +3,7 @@ package kafka
 import (
 	"context"
 	"fmt"
+	"strconv"
 
 	"github.com/ThreeDotsLabs/watermill/components/cqrs"
 	"github.com/ThreeDotsLabs/watermill/message"
@@ -28,6 +29,10 @@ func NewEventBus(pub message.Publisher, topic string) (*cqrs.EventBus, error) {
 		Marshaler: cqrs.JSONMarshaler{
 			GenerateName: cqrs.StructName,
 		},
+		OnPublish: func(params cqrs.OnEventSendParams) error {
+			setRouteMetadata(params.Message, params.EventName, params.Event)
+			return nil
+		},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("could not create cqrs event bus: %w", err)
@@ -35,3 +40,24 @@ func NewEventBus(pub message.Publisher, topic string) (*cqrs.EventBus, error) {
 
 	return bus, nil
 }
+
+// Message metadata set on every published event. The Kafka marshaler turns
+// metadata into Kafka headers, so consumers can route without decoding the payload.
+const (
+	MetadataEventType = "event_type"
+	MetadataChainID   = "chain_id"
+	MetadataUserID    = "user_id"
+	MetadataAddress   = "address"
+)
+
+func setRouteMetadata(msg *message.Message, eventName string, event any) {
+	msg.Metadata.Set(MetadataEventType, eventName)
+	r, ok := event.(interface{ Route() Route })
+	if !ok {
+		return
+	}
+	route := r.Route()
+	msg.Metadata.Set(MetadataChainID, strconv.FormatUint(route.ChainID, 10))
+	msg.Metadata.Set(MetadataUserID, route.UserID)
+	msg.Metadata.Set(MetadataAddress, route.Address)
+}
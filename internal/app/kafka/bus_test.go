@@ -0,0 +1,25 @@
+package kafka
+
+import (
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartitionKey(t *testing.T) {
+	msg := message.NewMessage("1", nil)
+	setRouteMetadata(msg, "MatchedTxEvent", MatchedTxEvent{UserID: "u1", Address: "0xabc", ChainID: 137})
+
+	require.Equal(t, "MatchedTxEvent", msg.Metadata.Get(MetadataEventType))
+	require.Equal(t, "137", msg.Metadata.Get(MetadataChainID))
+	require.Equal(t, "u1", PartitionKey(PartitionByUser, msg))
+	require.Equal(t, "0xabc", PartitionKey(PartitionByAddress, msg))
+	require.Equal(t, "137:u1", PartitionKey(PartitionByChainUser, msg))
+
+	// events without a route are published unkeyed
+	other := message.NewMessage("2", nil)
+	setRouteMetadata(other, "Other", struct{}{})
+	require.Equal(t, "Other", other.Metadata.Get(MetadataEventType))
+	require.Empty(t, PartitionKey(PartitionByChainUser, other))
+}
@@ -0,0 +1,276 @@
+package kafka
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ARK21/deblock/internal/app/metrics"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// ErrDeadLettered is returned for a message that couldn't be published but was
+// saved to a dead-letter sink, from which it can be redriven.
+var ErrDeadLettered = errors.New("event dead-lettered")
+
+// ErrDeadLetteredLocally comes with ErrDeadLettered when the message only
+// reached a FileDLQ: it isn't in Kafka until the file is redriven.
+var ErrDeadLetteredLocally = errors.New("held in the local dead-letter file")
+
+// DeadLetter is a message that couldn't be published, with everything needed
+// to publish it again.
+type DeadLetter struct {
+	Topic    string            `json:"topic"`
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata"`
+	Payload  json.RawMessage   `json:"payload"`
+	Error    string            `json:"error"`
+	Attempts int               `json:"attempts"`
+	FailedAt time.Time         `json:"failed_at"`
+}
+
+// Message rebuilds the original message.
+func (d DeadLetter) Message() *message.Message {
+	msg := message.NewMessage(d.UUID, message.Payload(d.Payload))
+	for k, v := range d.Metadata {
+		msg.Metadata.Set(k, v)
+	}
+	return msg
+}
+
+// DeadLetters is a place to park messages that failed to publish.
+type DeadLetters interface {
+	Put(d DeadLetter) error
+	Name() string
+}
+
+// TopicDLQ publishes dead letters to a Kafka topic, keeping the original metadata
+// as headers. The payload is the whole DeadLetter.
+type TopicDLQ struct {
+	Publisher message.Publisher
+	Topic     string
+}
+
+func (t *TopicDLQ) Name() string { return "topic" }
+
+func (t *TopicDLQ) Put(d DeadLetter) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	msg := message.NewMessage(d.UUID, b)
+	for k, v := range d.Metadata {
+		msg.Metadata.Set(k, v)
+	}
+	return t.Publisher.Publish(t.Topic, msg)
+}
+
+// FileDLQ appends dead letters to a local JSON lines file, for when Kafka itself is down.
+type FileDLQ struct {
+	Path string
+	mu   sync.Mutex
+}
+
+func (f *FileDLQ) Name() string { return "file" }
+
+func (f *FileDLQ) Put(d DeadLetter) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(b, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Sync()
+}
+
+// RetryingPublisher retries failed publishes with jittered exponential backoff.
+// A message still failing after Attempts goes to the first DLQ sink that accepts it.
+type RetryingPublisher struct {
+	Next       message.Publisher
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	DLQ        []DeadLetters
+}
+
+var _ message.Publisher = (*RetryingPublisher)(nil)
+
+func NewRetryingPublisher(next message.Publisher, attempts int, backoff time.Duration, dlq ...DeadLetters) *RetryingPublisher {
+	return &RetryingPublisher{Next: next, Attempts: attempts, Backoff: backoff, MaxBackoff: 5 * time.Second, DLQ: dlq}
+}
+
+func (p *RetryingPublisher) Publish(topic string, msgs ...*message.Message) error {
+	for _, msg := range msgs {
+		if err := p.publish(topic, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *RetryingPublisher) publish(topic string, msg *message.Message) error {
+	ctx := msg.Context()
+	backoff := p.Backoff
+	attempt := 1
+	err := p.Next.Publish(topic, msg)
+	for ; err != nil && attempt < p.Attempts && ctx.Err() == nil; attempt++ {
+		metrics.PublishRetry(topic)
+		wait := time.Duration(rand.Int63n(int64(max(backoff, 0))+1)) + time.Millisecond
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+		}
+		backoff = min(2*backoff, p.MaxBackoff)
+		err = p.Next.Publish(topic, msg)
+	}
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		// shutting down, not out of retries: the caller keeps the event for the next run
+		return fmt.Errorf("publish %s to %s: %w", msg.UUID, topic, err)
+	}
+
+	d := DeadLetter{
+		Topic:    topic,
+		UUID:     msg.UUID,
+		Metadata: map[string]string(msg.Metadata),
+		Payload:  json.RawMessage(msg.Payload),
+		Error:    err.Error(),
+		Attempts: attempt,
+		FailedAt: time.Now().UTC(),
+	}
+	for _, sink := range p.DLQ {
+		derr := sink.Put(d)
+		metrics.DeadLettered(sink.Name(), derr == nil)
+		if derr == nil {
+			if _, local := sink.(*FileDLQ); local {
+				return fmt.Errorf("%w, %w: %v", ErrDeadLettered, ErrDeadLetteredLocally, err)
+			}
+			return fmt.Errorf("%w to %s: %v", ErrDeadLettered, sink.Name(), err)
+		}
+		log.Printf("dead-letter %s %s: %v", sink.Name(), msg.UUID, derr)
+	}
+	return fmt.Errorf("publish %s to %s: %w", msg.UUID, topic, err)
+}
+
+func (p *RetryingPublisher) Close() error { return p.Next.Close() }
+
+// ReadDeadLetterFile returns the dead letters of a FileDLQ file; a missing file has none.
+func ReadDeadLetterFile(path string) ([]DeadLetter, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var out []DeadLetter
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var d DeadLetter
+		if err := json.Unmarshal(sc.Bytes(), &d); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		out = append(out, d)
+	}
+	return out, sc.Err()
+}
+
+// WriteDeadLetterFile replaces the file at path with letters.
+func WriteDeadLetterFile(path string, letters []DeadLetter) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, d := range letters {
+		if err := enc.Encode(d); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReadDeadLetterTopic returns the dead letters on topic up to its current end.
+func ReadDeadLetterTopic(ctx context.Context, brokers []string, topic string) ([]DeadLetter, error) {
+	end, err := EndOffsets(brokers, topic)
+	if err != nil {
+		return nil, err
+	}
+	if len(end) == 0 {
+		return nil, nil
+	}
+	sub, err := NewTopicReader(brokers)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Close()
+	msgs, err := sub.Subscribe(ctx, topic)
+	if err != nil {
+		return nil, fmt.Errorf("subscribe %s: %w", topic, err)
+	}
+
+	var out []DeadLetter
+	err = CatchUp(ctx, msgs, end, CatchUpIdle, VerifyTail(brokers, topic, CatchUpIdle), func(msg *message.Message) {
+		var d DeadLetter
+		if err := json.Unmarshal(msg.Payload, &d); err != nil {
+			log.Printf("skipping invalid dead letter %s: %v", msg.UUID, err)
+			return
+		}
+		out = append(out, d)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", topic, err)
+	}
+	return out, nil
+}
+
+// Redrive publishes letters to their original topic, or to topic when set,
+// and returns the ones that failed again.
+func Redrive(pub message.Publisher, letters []DeadLetter, topic string) (failed []DeadLetter) {
+	for _, d := range letters {
+		to := d.Topic
+		if topic != "" {
+			to = topic
+		}
+		if err := pub.Publish(to, d.Message()); err != nil {
+			log.Printf("redrive %s to %s: %v", d.UUID, to, err)
+			d.Error = err.Error()
+			failed = append(failed, d)
+		}
+	}
+	return failed
+}
@@ -0,0 +1,99 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/stretchr/testify/require"
+)
+
+// failingPub fails the first fails publishes and records the rest.
+type failingPub struct {
+	fails int
+	calls int
+	sent  []*message.Message
+}
+
+func (f *failingPub) Publish(_ string, msgs ...*message.Message) error {
+	f.calls++
+	if f.calls <= f.fails {
+		return errors.New("broker down")
+	}
+	f.sent = append(f.sent, msgs...)
+	return nil
+}
+
+func (f *failingPub) Close() error { return nil }
+
+type brokenDLQ struct{}
+
+func (brokenDLQ) Put(DeadLetter) error { return errors.New("broker down") }
+func (brokenDLQ) Name() string         { return "topic" }
+
+func TestRetryingPublisher_RetriesThenSucceeds(t *testing.T) {
+	next := &failingPub{fails: 2}
+	p := NewRetryingPublisher(next, 3, time.Millisecond)
+
+	require.NoError(t, p.Publish("events", message.NewMessage("1", []byte(`{}`))))
+	require.Equal(t, 3, next.calls)
+	require.Len(t, next.sent, 1)
+}
+
+func TestRetryingPublisher_DeadLettersAndRedrives(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dlq.jsonl")
+	next := &failingPub{fails: 100}
+	p := NewRetryingPublisher(next, 2, time.Millisecond, brokenDLQ{}, &FileDLQ{Path: path})
+
+	msg := message.NewMessage("id-1", []byte(`{"user_id":"u1"}`))
+	msg.Metadata.Set(MetadataUserID, "u1")
+	err := p.Publish("events", msg)
+	require.ErrorIs(t, err, ErrDeadLettered)
+	require.ErrorIs(t, err, ErrDeadLetteredLocally)
+	require.Equal(t, 2, next.calls)
+
+	letters, err := ReadDeadLetterFile(path)
+	require.NoError(t, err)
+	require.Len(t, letters, 1)
+	d := letters[0]
+	require.Equal(t, "events", d.Topic)
+	require.Equal(t, "id-1", d.UUID)
+	require.Equal(t, "u1", d.Metadata[MetadataUserID])
+	require.Equal(t, 2, d.Attempts)
+	require.Contains(t, d.Error, "broker down")
+
+	// the broker is back: the event goes out unchanged
+	out := &failingPub{}
+	require.Empty(t, Redrive(out, letters, ""))
+	require.Len(t, out.sent, 1)
+	require.Equal(t, "id-1", out.sent[0].UUID)
+	require.JSONEq(t, `{"user_id":"u1"}`, string(out.sent[0].Payload))
+	require.Equal(t, "u1", out.sent[0].Metadata.Get(MetadataUserID))
+}
+
+func TestRetryingPublisher_NoSinkAcceptsReturnsError(t *testing.T) {
+	p := NewRetryingPublisher(&failingPub{fails: 100}, 1, time.Millisecond, brokenDLQ{})
+	err := p.Publish("events", message.NewMessage("1", []byte(`{}`)))
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrDeadLettered))
+}
+
+func TestRetryingPublisher_CancelledDoesNotDeadLetter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dlq.jsonl")
+	p := NewRetryingPublisher(&failingPub{fails: 100}, 5, time.Millisecond, &FileDLQ{Path: path})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	msg := message.NewMessage("1", []byte(`{}`))
+	msg.SetContext(ctx)
+	err := p.Publish("events", msg)
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrDeadLettered))
+
+	letters, err := ReadDeadLetterFile(path)
+	require.NoError(t, err)
+	require.Empty(t, letters)
+}
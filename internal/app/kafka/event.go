@@ -1,6 +1,7 @@
 package kafka
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -10,8 +11,15 @@ type MessageHeader struct {
 	ID          string `json:"id"`
 	EventName   string `json:"event_name"`
 	PublishedAt string `json:"published_at"`
+
+	// FactID is the same for every emission of one on-chain fact, whichever block
+	// carried it. An event with a known FactID but a new ID was re-emitted after
+	// its tx moved to a block with another hash (BlockHash).
+	FactID    string `json:"fact_id,omitempty"`
+	BlockHash string `json:"block_hash,omitempty"`
 }
 
+// NewMessageHeader returns a header with a random ID.
 func NewMessageHeader(eventName string) MessageHeader {
 	return MessageHeader{
 		ID:          uuid.NewString(),
@@ -20,6 +28,55 @@ func NewMessageHeader(eventName string) MessageHeader {
 	}
 }
 
+// eventNamespace is the UUIDv5 namespace of event IDs.
+var eventNamespace = uuid.NewSHA1(uuid.NameSpaceURL, []byte("https://github.com/ARK21/deblock/events"))
+
+// EventKey identifies one on-chain fact as seen by one user.
+type EventKey struct {
+	ChainID   uint64 `json:"chain_id"`
+	BlockHash string `json:"block_hash"`
+	TxHash    string `json:"tx_hash"`
+	// Index locates the fact inside the tx: "" for the tx itself,
+	// LogIndex of the log's position in the receipt for a log and
+	// TracePath for an internal call.
+	Index     string `json:"index,omitempty"`
+	UserID    string `json:"user_id"`
+	Direction string `json:"direction"`
+}
+
+func LogIndex(i uint64) string { return fmt.Sprintf("log:%d", i) }
+
+func TracePath(path []int) string { return fmt.Sprintf("trace:%v", path) }
+
+// NewEventHeader returns a header whose ID is derived from k, so that processing
+// the same block twice yields the same IDs.
+func NewEventHeader(eventName string, k EventKey) MessageHeader {
+	fact := fmt.Sprintf("%s|%d|%s|%s|%s|%s", eventName, k.ChainID, k.TxHash, k.Index, k.UserID, k.Direction)
+	return MessageHeader{
+		ID:          uuid.NewSHA1(eventNamespace, []byte(fact+"|"+k.BlockHash)).String(),
+		EventName:   eventName,
+		PublishedAt: time.Now().Format(time.RFC3339),
+		FactID:      uuid.NewSHA1(eventNamespace, []byte(fact)).String(),
+		BlockHash:   k.BlockHash,
+	}
+}
+
+// Route is what an event is keyed and routed by in Kafka.
+type Route struct {
+	UserID  string
+	Address string
+	ChainID uint64
+}
+
+func (e MatchedTxEvent) Route() Route       { return Route{e.UserID, e.Address, e.ChainID} }
+func (e TokenTransferEvent) Route() Route   { return Route{e.UserID, e.Address, e.ChainID} }
+func (e ERC721TransferEvent) Route() Route  { return Route{e.UserID, e.Address, e.ChainID} }
+func (e ERC1155TransferEvent) Route() Route { return Route{e.UserID, e.Address, e.ChainID} }
+func (e TxRetractedEvent) Route() Route     { return Route{e.UserID, e.Address, e.ChainID} }
+func (e ReorgDetectedEvent) Route() Route   { return Route{ChainID: e.ChainID} }
+func (e ReorgResolvedEvent) Route() Route   { return Route{ChainID: e.ChainID} }
+func (e DeepReorgEvent) Route() Route       { return Route{ChainID: e.ChainID} }
+
 type MatchedTxEvent struct {
 	Header MessageHeader `json:"header"`
 
@@ -32,6 +89,10 @@ type MatchedTxEvent struct {
 	From        string `json:"from"`
 	To          string `json:"to"`
 
+	// Label and Tags are copied from the address file entry of Address.
+	Label string   `json:"label,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+
 	AmountWei string `json:"amount_wei"`
 	AmountEth string `json:"amount_eth"`
 	FeeWei    string `json:"fee_wei"`
@@ -40,4 +101,209 @@ type MatchedTxEvent struct {
 	Status  string `json:"status"`
 	ChainID uint64 `json:"chain_id"`
 	Reorged bool   `json:"reorged"`
+
+	// Internal marks value moved by a contract call inside the tx rather than by the tx itself.
+	// TracePath locates that call in the tx call tree.
+	Internal  bool  `json:"internal"`
+	TracePath []int `json:"trace_path,omitempty"`
+}
+
+// TokenTransferEvent is emitted for an ERC-20 Transfer log touching a tracked address.
+// AmountRaw is in the token's base units; decimals are left to consumers.
+// TxLogIndex, here and in the other token events, is the log's position in its
+// tx receipt: unlike LogIndex it stays the same when a reorg moves the tx.
+type TokenTransferEvent struct {
+	Header MessageHeader `json:"header"`
+
+	UserID      string `json:"user_id"`
+	Address     string `json:"address"`
+	Direction   string `json:"direction"`
+	TxHash      string `json:"tx_hash"`
+	LogIndex    uint64 `json:"log_index"`
+	TxLogIndex  uint64 `json:"tx_log_index"`
+	BlockNumber uint64 `json:"block_number"`
+	BlockTime   int64  `json:"block_time"`
+	Token       string `json:"token"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+
+	AmountRaw string `json:"amount_raw"`
+
+	ChainID uint64 `json:"chain_id"`
+	Reorged bool   `json:"reorged"`
+}
+
+// ERC721TransferEvent is emitted for an ERC-721 Transfer log touching a tracked address.
+type ERC721TransferEvent struct {
+	Header MessageHeader `json:"header"`
+
+	UserID      string `json:"user_id"`
+	Address     string `json:"address"`
+	Direction   string `json:"direction"`
+	TxHash      string `json:"tx_hash"`
+	LogIndex    uint64 `json:"log_index"`
+	TxLogIndex  uint64 `json:"tx_log_index"`
+	BlockNumber uint64 `json:"block_number"`
+	BlockTime   int64  `json:"block_time"`
+	Contract    string `json:"contract"`
+	From        string `json:"from"`
+	To          string `json:"to"`
+	TokenID     string `json:"token_id"`
+
+	ChainID uint64 `json:"chain_id"`
+	Reorged bool   `json:"reorged"`
+}
+
+// ERC1155TransferEvent is emitted for an ERC-1155 TransferSingle or TransferBatch log
+// touching a tracked address. TokenIDs and Quantities are index-aligned.
+type ERC1155TransferEvent struct {
+	Header MessageHeader `json:"header"`
+
+	UserID      string   `json:"user_id"`
+	Address     string   `json:"address"`
+	Direction   string   `json:"direction"`
+	TxHash      string   `json:"tx_hash"`
+	LogIndex    uint64   `json:"log_index"`
+	TxLogIndex  uint64   `json:"tx_log_index"`
+	BlockNumber uint64   `json:"block_number"`
+	BlockTime   int64    `json:"block_time"`
+	Contract    string   `json:"contract"`
+	Operator    string   `json:"operator"`
+	From        string   `json:"from"`
+	To          string   `json:"to"`
+	TokenIDs    []string `json:"token_ids"`
+	Quantities  []string `json:"quantities"`
+
+	ChainID uint64 `json:"chain_id"`
+	Reorged bool   `json:"reorged"`
+}
+
+// TxRetractedEvent withdraws an event published for a block orphaned by a reorg,
+// whose fact doesn't reappear on the new canonical chain. The header's BlockHash
+// is the orphaned block.
+type TxRetractedEvent struct {
+	Header MessageHeader `json:"header"`
+
+	// RetractedID and RetractedEvent are header.id and header.event_name of the withdrawn event.
+	RetractedID    string `json:"retracted_id"`
+	RetractedEvent string `json:"retracted_event"`
+
+	UserID      string `json:"user_id"`
+	Address     string `json:"address"`
+	Direction   string `json:"direction"`
+	TxHash      string `json:"tx_hash"`
+	BlockNumber uint64 `json:"block_number"`
+
+	ChainID uint64 `json:"chain_id"`
+}
+
+// Emitted is what is kept of a published event to retract it after a reorg.
+type Emitted struct {
+	ID          string   `json:"id"`
+	FactID      string   `json:"fact_id"`
+	EventName   string   `json:"event_name"`
+	Key         EventKey `json:"key"`
+	Address     string   `json:"address"`
+	BlockNumber uint64   `json:"block_number"`
+}
+
+// Emission returns the record of a published event, if it is an on-chain fact.
+func Emission(event any) (Emitted, bool) {
+	var h MessageHeader
+	var r Route
+	var key EventKey
+	var number uint64
+	switch e := event.(type) {
+	case MatchedTxEvent:
+		index := ""
+		if e.Internal {
+			index = TracePath(e.TracePath)
+		}
+		h, r, number = e.Header, e.Route(), e.BlockNumber
+		key = EventKey{TxHash: e.TxHash, Index: index, Direction: e.Direction}
+	case TokenTransferEvent:
+		h, r, number = e.Header, e.Route(), e.BlockNumber
+		key = EventKey{TxHash: e.TxHash, Index: LogIndex(e.TxLogIndex), Direction: e.Direction}
+	case ERC721TransferEvent:
+		h, r, number = e.Header, e.Route(), e.BlockNumber
+		key = EventKey{TxHash: e.TxHash, Index: LogIndex(e.TxLogIndex), Direction: e.Direction}
+	case ERC1155TransferEvent:
+		h, r, number = e.Header, e.Route(), e.BlockNumber
+		key = EventKey{TxHash: e.TxHash, Index: LogIndex(e.TxLogIndex), Direction: e.Direction}
+	default:
+		return Emitted{}, false
+	}
+	key.ChainID, key.BlockHash, key.UserID = r.ChainID, h.BlockHash, r.UserID
+	return Emitted{
+		ID:          h.ID,
+		FactID:      h.FactID,
+		EventName:   h.EventName,
+		Key:         key,
+		Address:     r.Address,
+		BlockNumber: number,
+	}, true
+}
+
+// NewTxRetractedEvent returns the retraction of e. Its ID is derived from e, so
+// retracting e twice yields the same event.
+func NewTxRetractedEvent(e Emitted) TxRetractedEvent {
+	key := e.Key
+	key.Index = e.EventName + "/" + key.Index
+	return TxRetractedEvent{
+		Header:         NewEventHeader("TxRetractedEvent", key),
+		RetractedID:    e.ID,
+		RetractedEvent: e.EventName,
+		UserID:         e.Key.UserID,
+		Address:        e.Address,
+		Direction:      e.Key.Direction,
+		TxHash:         e.Key.TxHash,
+		BlockNumber:    e.BlockNumber,
+		ChainID:        e.Key.ChainID,
+	}
+}
+
+// ReorgDetectedEvent announces a reorg before the new canonical blocks are reprocessed.
+// OrphanedHashes and NewHashes are the blocks above the common ancestor, lowest first.
+type ReorgDetectedEvent struct {
+	Header MessageHeader `json:"header"`
+
+	ChainID        uint64   `json:"chain_id"`
+	AncestorNumber uint64   `json:"ancestor_number"`
+	AncestorHash   string   `json:"ancestor_hash"`
+	OrphanedHashes []string `json:"orphaned_hashes"`
+	NewHashes      []string `json:"new_hashes"`
+	Depth          uint64   `json:"depth"`
+	// AffectedEvents is the number of tracked-user events published for the orphaned blocks.
+	AffectedEvents int `json:"affected_events"`
+}
+
+// ReorgResolvedEvent follows a ReorgDetectedEvent once the new canonical blocks are
+// reprocessed and the vanished events retracted.
+type ReorgResolvedEvent struct {
+	Header MessageHeader `json:"header"`
+
+	// ReorgID is the header.id of the ReorgDetectedEvent.
+	ReorgID        string `json:"reorg_id"`
+	ChainID        uint64 `json:"chain_id"`
+	AncestorNumber uint64 `json:"ancestor_number"`
+	NewHeadNumber  uint64 `json:"new_head_number"`
+	NewHeadHash    string `json:"new_head_hash"`
+	Reprocessed    int    `json:"reprocessed_blocks"`
+	Matched        int    `json:"matched"`
+	Retracted      int    `json:"retracted"`
+}
+
+// DeepReorgEvent alerts that a reorg reached below the reorg window and says how
+// the watcher handled it: "halted", "resynced" from ResyncFrom, or "widened" to
+// find AncestorNumber further back.
+type DeepReorgEvent struct {
+	Header MessageHeader `json:"header"`
+
+	ChainID        uint64 `json:"chain_id"`
+	BlockNumber    uint64 `json:"block_number"`
+	BlockHash      string `json:"block_hash"`
+	Policy         string `json:"policy"`
+	Outcome        string `json:"outcome"`
+	AncestorNumber uint64 `json:"ancestor_number,omitempty"`
+	ResyncFrom     uint64 `json:"resync_from,omitempty"`
 }
@@ -13,15 +13,41 @@ type Producer interface {
 	Close() error
 }
 
-func NewKafkaPublisher(brokers []string) (message.Publisher, error) {
+// Partitioning strategies: the route fields Kafka messages are keyed by. Keying keeps
+// the events of one key on one partition, in publish order.
+const (
+	PartitionByUser      = "user"
+	PartitionByAddress   = "address"
+	PartitionByChainUser = "chain_user"
+)
+
+// PartitionKey returns the Kafka key of msg under the partitionBy strategy.
+// Messages without route metadata get no key.
+func PartitionKey(partitionBy string, msg *message.Message) string {
+	switch partitionBy {
+	case PartitionByAddress:
+		return msg.Metadata.Get(MetadataAddress)
+	case PartitionByChainUser:
+		if msg.Metadata.Get(MetadataUserID) == "" {
+			return ""
+		}
+		return msg.Metadata.Get(MetadataChainID) + ":" + msg.Metadata.Get(MetadataUserID)
+	default:
+		return msg.Metadata.Get(MetadataUserID)
+	}
+}
+
+func NewKafkaPublisher(brokers []string, partitionBy string) (message.Publisher, error) {
 	logger := watermill.NewStdLogger(false, false)
 
 	var pub message.Publisher
 
 	pub, err := kafka.NewPublisher(
 		kafka.PublisherConfig{
-			Brokers:   brokers,
-			Marshaler: kafka.DefaultMarshaler{},
+			Brokers: brokers,
+			Marshaler: kafka.NewWithPartitioningMarshaler(func(_ string, msg *message.Message) (string, error) {
+				return PartitionKey(partitionBy, msg), nil
+			}),
 		},
 		logger,
 	)
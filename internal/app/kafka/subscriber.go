@@ -0,0 +1,169 @@
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// NewTopicReader returns a subscriber that reads every partition from the oldest
+// offset without a consumer group, so each start sees the whole (compacted) topic.
+func NewTopicReader(brokers []string) (message.Subscriber, error) {
+	logger := watermill.NewStdLogger(false, false)
+
+	conf := kafka.DefaultSaramaSubscriberConfig()
+	conf.Consumer.Offsets.Initial = sarama.OffsetOldest
+
+	sub, err := kafka.NewSubscriber(
+		kafka.SubscriberConfig{
+			Brokers:               brokers,
+			Unmarshaler:           kafka.DefaultMarshaler{},
+			OverwriteSaramaConfig: conf,
+		},
+		logger,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creating kafka subscriber: %w", err)
+	}
+
+	return sub, nil
+}
+
+// EndOffsets returns the high-water mark of every non-empty partition of topic.
+// A reader has caught up once it has seen offset end-1 on each of them.
+func EndOffsets(brokers []string, topic string) (map[int32]int64, error) {
+	client, err := sarama.NewClient(brokers, sarama.NewConfig())
+	if err != nil {
+		return nil, fmt.Errorf("kafka client: %w", err)
+	}
+	defer client.Close()
+
+	parts, err := client.Partitions(topic)
+	if err != nil {
+		return nil, fmt.Errorf("partitions of %s: %w", topic, err)
+	}
+	out := make(map[int32]int64, len(parts))
+	for _, p := range parts {
+		oldest, err := client.GetOffset(topic, p, sarama.OffsetOldest)
+		if err != nil {
+			return nil, fmt.Errorf("oldest offset %s/%d: %w", topic, p, err)
+		}
+		newest, err := client.GetOffset(topic, p, sarama.OffsetNewest)
+		if err != nil {
+			return nil, fmt.Errorf("newest offset %s/%d: %w", topic, p, err)
+		}
+		if newest > oldest {
+			out[p] = newest
+		}
+	}
+	return out, nil
+}
+
+// MessageKey returns the Kafka key of a consumed message.
+func MessageKey(msg *message.Message) string {
+	key, _ := kafka.MessageKeyFromCtx(msg.Context())
+	return string(key)
+}
+
+// MessagePosition returns the partition and offset of a consumed message.
+func MessagePosition(msg *message.Message) (int32, int64, bool) {
+	p, ok1 := kafka.MessagePartitionFromCtx(msg.Context())
+	off, ok2 := kafka.MessagePartitionOffsetFromCtx(msg.Context())
+	return p, off, ok1 && ok2
+}
+
+// CatchUpIdle is how long CatchUp waits for the next message before it checks
+// whether the remaining partitions hold anything more.
+const CatchUpIdle = 10 * time.Second
+
+// TailCheck returns nil if the partitions in end hold no record left to read
+// from the offsets in next, up to their end. A partition missing from next
+// hasn't been read at all.
+type TailCheck func(ctx context.Context, next, end map[int32]int64) error
+
+// CatchUp passes the messages of msgs to fn, acking them, until every partition
+// in end has been read up to its high-water mark. The last offsets of a partition
+// may never be delivered (transaction markers, records removed by compaction), so
+// once no message arrived for idle, check decides whether the remaining
+// partitions are read; if they aren't, CatchUp fails.
+func CatchUp(ctx context.Context, msgs <-chan *message.Message, end map[int32]int64, idle time.Duration, check TailCheck, fn func(*message.Message)) error {
+	next := make(map[int32]int64, len(end))
+	t := time.NewTimer(idle)
+	defer t.Stop()
+	for len(end) > 0 {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return fmt.Errorf("subscription closed during catch-up")
+			}
+			fn(msg)
+			if p, off, ok := MessagePosition(msg); ok {
+				next[p] = off + 1
+				if off+1 >= end[p] {
+					delete(end, p)
+				}
+			}
+			msg.Ack()
+			t.Reset(idle)
+		case <-t.C:
+			if err := check(ctx, next, end); err != nil {
+				return fmt.Errorf("no message for %s short of end offsets %v: %w", idle, end, err)
+			}
+			log.Printf("[kafka] no message for %s, partitions %v hold nothing more up to their end", idle, end)
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// VerifyTail returns a TailCheck that reads each partition of topic from its next
+// offset with a consumer of its own. A record below the end means the reader
+// stopped short of it; none within wait means the offsets left are transaction
+// markers or compacted records.
+func VerifyTail(brokers []string, topic string, wait time.Duration) TailCheck {
+	return func(ctx context.Context, next, end map[int32]int64) error {
+		consumer, err := sarama.NewConsumer(brokers, sarama.NewConfig())
+		if err != nil {
+			return fmt.Errorf("kafka consumer: %w", err)
+		}
+		defer consumer.Close()
+		return verifyTail(ctx, consumer, topic, next, end, wait)
+	}
+}
+
+func verifyTail(ctx context.Context, consumer sarama.Consumer, topic string, next, end map[int32]int64, wait time.Duration) error {
+	for p, e := range end {
+		from, ok := next[p]
+		if !ok {
+			from = sarama.OffsetOldest
+		}
+		pc, err := consumer.ConsumePartition(topic, p, from)
+		if err != nil {
+			return fmt.Errorf("read %s/%d from %d: %w", topic, p, from, err)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case msg := <-pc.Messages():
+			if msg.Offset < e {
+				err = fmt.Errorf("%s/%d has a record at %d below its end %d", topic, p, msg.Offset, e)
+			}
+		case <-t.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		t.Stop()
+		pc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package kafka
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatchUp_EndsWhenLastOffsetNeverArrives(t *testing.T) {
+	// the high-water mark is 5, but offset 4 is a transaction marker and never delivered
+	msgs := make(chan *message.Message, 2)
+	msgs <- message.NewMessage("a", nil)
+	msgs <- message.NewMessage("b", nil)
+
+	var got []string
+	var checked map[int32]int64
+	tailEmpty := func(_ context.Context, _, end map[int32]int64) error {
+		checked = end
+		return nil
+	}
+	err := CatchUp(context.Background(), msgs, map[int32]int64{0: 5}, 20*time.Millisecond, tailEmpty, func(m *message.Message) {
+		got = append(got, m.UUID)
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, got)
+	require.Equal(t, map[int32]int64{0: 5}, checked)
+}
+
+func TestCatchUp_FailsWhenTailHoldsRecords(t *testing.T) {
+	msgs := make(chan *message.Message)
+	stalled := func(context.Context, map[int32]int64, map[int32]int64) error {
+		return errors.New("record at 3 below its end 5")
+	}
+	err := CatchUp(context.Background(), msgs, map[int32]int64{0: 5}, 20*time.Millisecond, stalled, func(*message.Message) {})
+	require.ErrorContains(t, err, "record at 3")
+}
+
+func TestCatchUp_ClosedSubscription(t *testing.T) {
+	msgs := make(chan *message.Message)
+	close(msgs)
+	err := CatchUp(context.Background(), msgs, map[int32]int64{0: 5}, time.Second, nil, func(*message.Message) {})
+	require.Error(t, err)
+}
+
+func TestVerifyTail(t *testing.T) {
+	consumer := mocks.NewConsumer(t, nil)
+	// partition 0 was read to 4 and offset 4 is a marker; partition 1 still has offset 3
+	consumer.ExpectConsumePartition("users", 0, 4)
+	consumer.ExpectConsumePartition("users", 1, 3).YieldMessage(&sarama.ConsumerMessage{Value: []byte("{}")})
+
+	err := verifyTail(context.Background(), consumer, "users", map[int32]int64{0: 4, 1: 3}, map[int32]int64{0: 5}, 20*time.Millisecond)
+	require.NoError(t, err)
+	err = verifyTail(context.Background(), consumer, "users", map[int32]int64{0: 4, 1: 3}, map[int32]int64{1: 5}, 20*time.Millisecond)
+	require.ErrorContains(t, err, "users/1 has a record at 3 below its end 5")
+	require.NoError(t, consumer.Close())
+}
@@ -1,6 +1,9 @@
 package metrics
 
 import (
+	"fmt"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -9,25 +12,50 @@ import (
 
 var (
 	//Gauges
-	headBlock      = prometheus.NewGauge(prometheus.GaugeOpts{Name: "eth_head_block"})
-	finalizedBlock = prometheus.NewGauge(prometheus.GaugeOpts{Name: "eth_finalized_block"})
-	lagBlocks      = prometheus.NewGauge(prometheus.GaugeOpts{Name: "eth_finalized_lag_blocks"})
-	wsConnected    = prometheus.NewGauge(prometheus.GaugeOpts{Name: "ws_connected"})
+	headBlock      = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "eth_head_block"}, []string{"chain"})
+	finalizedBlock = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "eth_finalized_block"}, []string{"chain"})
+	lagBlocks      = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "eth_finalized_lag_blocks"}, []string{"chain"})
+	finalityLag    = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "finality_lag_blocks"}, []string{"chain", "strategy"})
+	wsConnected    = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ws_connected"}, []string{"chain"})
 
-	inflightReceipts = prometheus.NewGauge(prometheus.GaugeOpts{Name: "rpc_receipts_inflight"})
+	backfillCommitted = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "backfill_committed_block"}, []string{"chain"})
+	backfillTarget    = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "backfill_target_block"}, []string{"chain"})
+	backfillRate      = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "backfill_blocks_per_second"}, []string{"chain"})
+	backfillETA       = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "backfill_eta_seconds"}, []string{"chain"})
+
+	stuckBlock = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "stuck_block"}, []string{"chain"})
+
+	inflightReceipts = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "rpc_receipts_inflight"}, []string{"chain"})
+	addressesTracked = prometheus.NewGauge(prometheus.GaugeOpts{Name: "addresses_tracked"})
 
 	// Counters
-	blockProcessed  = prometheus.NewCounter(prometheus.CounterOpts{Name: "block_processed_total"})
-	reprocessed     = prometheus.NewCounter(prometheus.CounterOpts{Name: "block_reprocessed_total"})
-	txsMatched      = prometheus.NewCounter(prometheus.CounterOpts{Name: "txs_matched_total"})
-	eventsPublished = prometheus.NewCounter(prometheus.CounterOpts{Name: "events_published_total"})
-	reorgsTotal     = prometheus.NewCounter(prometheus.CounterOpts{Name: "reorgs_total"})
-
-	rpcCalls         = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rpc_calls_total"}, []string{"method", "result"})
-	receiptBatchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+	blockProcessed  = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "block_processed_total"}, []string{"chain"})
+	reprocessed     = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "block_reprocessed_total"}, []string{"chain"})
+	txsMatched      = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "txs_matched_total"}, []string{"chain"})
+	eventsPublished = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "events_published_total"}, []string{"chain"})
+	reorgsTotal     = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "reorgs_total"}, []string{"chain"})
+	deepReorgs      = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "deep_reorgs_total"}, []string{"chain", "outcome"})
+	blockFailures   = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "block_delivery_failures_total"}, []string{"chain"})
+
+	publishRetries = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "publish_retries_total"}, []string{"topic"})
+	deadLettered   = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "events_dead_lettered_total"}, []string{"sink", "result"})
+
+	addressReloads   = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "address_reloads_total"}, []string{"result"})
+	addressesAdded   = prometheus.NewCounter(prometheus.CounterOpts{Name: "addresses_added_total"})
+	addressesRemoved = prometheus.NewCounter(prometheus.CounterOpts{Name: "addresses_removed_total"})
+
+	rpcCalls         = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rpc_calls_total"}, []string{"chain", "provider", "method", "result"})
+	rpcFailovers     = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rpc_failovers_total"}, []string{"chain", "provider"})
+	providerHealthy  = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "rpc_provider_healthy"}, []string{"chain", "provider"})
+	providerHead     = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "rpc_provider_head_block"}, []string{"chain", "provider"})
+	rpcRetries       = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rpc_retries_total"}, []string{"chain", "method"})
+	rpcThrottled     = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "rpc_throttled_total"}, []string{"chain", "provider", "method"})
+	rpcLimit         = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "rpc_limit"}, []string{"chain", "provider", "limit"})
+	receiptFetches   = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "receipt_fetches_total"}, []string{"chain", "strategy"})
+	receiptBatchSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
 		Name:    "rpc_receipts_batch_size",
 		Buckets: []float64{1, 5, 10, 20, 50, 100, 200},
-	})
+	}, []string{"chain"})
 )
 
 func init() {
@@ -35,102 +63,313 @@ func init() {
 		headBlock,
 		finalizedBlock,
 		lagBlocks,
+		finalityLag,
 		wsConnected,
+		stuckBlock,
 		inflightReceipts,
+		addressesTracked,
+		backfillCommitted,
+		backfillTarget,
+		backfillRate,
+		backfillETA,
 
 		blockProcessed,
 		reprocessed,
 		txsMatched,
 		eventsPublished,
 		reorgsTotal,
+		deepReorgs,
+		blockFailures,
+		publishRetries,
+		deadLettered,
+		addressReloads,
+		addressesAdded,
+		addressesRemoved,
 
 		rpcCalls,
+		rpcFailovers,
+		providerHealthy,
+		providerHead,
+		rpcRetries,
+		rpcThrottled,
+		rpcLimit,
+		receiptFetches,
 		receiptBatchSize,
 	)
 }
 
-var (
+// Chain records the pipeline metrics of one chain under its "chain" label.
+// A nil *Chain records under Default, so components work unbound in tests.
+type Chain struct {
+	name     string
+	provider string
+
+	head              uint64
+	finalized         uint64
 	lastHeadUnix      int64 // unix seconds
 	lastFinalizedUnix int64
 	lastRPCErrUnix    int64
 	wsUp              uint32
+
+	halted  uint32       // set when a deep reorg halted the chain
+	stopped atomic.Value // why the chain's pipeline stopped, if it did
+
+	stuckMu        sync.Mutex
+	stuck          uint64 // lowest block failing delivery, 0 if none
+	stuckSinceUnix int64
+}
+
+var (
+	chainsMu sync.Mutex
+	chains   = map[string]*Chain{}
 )
 
-func SetHead(n uint64) {
-	headBlock.Set(float64(n))
-	atomic.StoreInt64(&lastHeadUnix, time.Now().Unix())
-	updateLag()
+// Default collects metrics of components that aren't bound to a chain.
+var Default = &Chain{name: "default"}
+
+// ForChain returns the metrics of the named chain and includes it in IsHealthy.
+func ForChain(name string) *Chain {
+	chainsMu.Lock()
+	defer chainsMu.Unlock()
+	if c, ok := chains[name]; ok {
+		return c
+	}
+	c := &Chain{name: name}
+	chains[name] = c
+	return c
+}
+
+func (c *Chain) or() *Chain {
+	if c == nil {
+		return Default
+	}
+	return c
+}
+
+func (c *Chain) Name() string { return c.or().name }
+
+// Provider returns a handle labelling RPC calls with the provider name. Its errors
+// don't affect the chain's health; RPCUnavailable reports when no provider answers.
+func (c *Chain) Provider(name string) *Chain {
+	return &Chain{name: c.Name(), provider: name}
 }
 
-func SetFinalized(n uint64) {
-	finalizedBlock.Set(float64(n))
-	atomic.StoreInt64(&lastFinalizedUnix, time.Now().Unix())
-	updateLag()
+func (c *Chain) SetHead(n uint64) {
+	c = c.or()
+	headBlock.WithLabelValues(c.name).Set(float64(n))
+	atomic.StoreUint64(&c.head, n)
+	atomic.StoreInt64(&c.lastHeadUnix, time.Now().Unix())
+	c.updateLag()
 }
 
-func SetWSUp(up bool) {
+func (c *Chain) SetFinalized(n uint64) {
+	c = c.or()
+	finalizedBlock.WithLabelValues(c.name).Set(float64(n))
+	atomic.StoreUint64(&c.finalized, n)
+	atomic.StoreInt64(&c.lastFinalizedUnix, time.Now().Unix())
+	c.updateLag()
+}
+
+func (c *Chain) SetWSUp(up bool) {
+	c = c.or()
 	if up {
-		atomic.StoreUint32(&wsUp, 1)
-		wsConnected.Set(1)
+		atomic.StoreUint32(&c.wsUp, 1)
+		wsConnected.WithLabelValues(c.name).Set(1)
 	} else {
-		atomic.StoreUint32(&wsUp, 0)
-		wsConnected.Set(0)
+		atomic.StoreUint32(&c.wsUp, 0)
+		wsConnected.WithLabelValues(c.name).Set(0)
 	}
 }
 
-func IncBlocksProcessed() {
-	blockProcessed.Inc()
+func (c *Chain) IncBlocksProcessed() {
+	blockProcessed.WithLabelValues(c.Name()).Inc()
 }
 
-func IncReprocessed() {
-	reprocessed.Inc()
+func (c *Chain) IncReprocessed() {
+	reprocessed.WithLabelValues(c.Name()).Inc()
 }
 
-func AddTxsMatched(n int) {
+func (c *Chain) AddTxsMatched(n int) {
 	if n > 0 {
-		txsMatched.Add(float64(n))
+		txsMatched.WithLabelValues(c.Name()).Add(float64(n))
 	}
 }
 
-func AddEventsPublished(n int) {
+func (c *Chain) AddEventsPublished(n int) {
 	if n > 0 {
-		eventsPublished.Add(float64(n))
+		eventsPublished.WithLabelValues(c.Name()).Add(float64(n))
+	}
+}
+
+// BlockFailed records a failed attempt at delivering the events of block n.
+func (c *Chain) BlockFailed(n uint64) {
+	c = c.or()
+	blockFailures.WithLabelValues(c.name).Inc()
+	c.stuckMu.Lock()
+	defer c.stuckMu.Unlock()
+	if c.stuck == 0 || n < c.stuck {
+		if c.stuck == 0 {
+			c.stuckSinceUnix = time.Now().Unix()
+		}
+		c.stuck = n
+		stuckBlock.WithLabelValues(c.name).Set(float64(n))
+	}
+}
+
+// BlockDelivered records that every event of block n was delivered.
+func (c *Chain) BlockDelivered(n uint64) {
+	c = c.or()
+	c.stuckMu.Lock()
+	defer c.stuckMu.Unlock()
+	if c.stuck != 0 && n >= c.stuck {
+		c.stuck = 0
+		stuckBlock.WithLabelValues(c.name).Set(0)
+	}
+}
+
+// DeepReorg counts a reorg deeper than the window by outcome; "halted" marks the chain unhealthy.
+func (c *Chain) DeepReorg(outcome string) {
+	c = c.or()
+	deepReorgs.WithLabelValues(c.name, outcome).Inc()
+	if outcome == "halted" {
+		atomic.StoreUint32(&c.halted, 1)
 	}
 }
 
-func IncReorg() {
-	reorgsTotal.Inc()
+// Stopped marks the chain unhealthy because its pipeline ended with err.
+func (c *Chain) Stopped(err error) {
+	c.or().stopped.Store(err.Error())
+}
+
+// Restarted clears Stopped once the chain's pipeline runs again.
+func (c *Chain) Restarted() {
+	c.or().stopped.Store("")
+}
+
+func (c *Chain) IncReorg() {
+	reorgsTotal.WithLabelValues(c.Name()).Inc()
 }
 
-func RPCCall(method string, ok bool) {
-	rpcCalls.WithLabelValues(method, map[bool]string{true: "ok", false: "err"}[ok]).Inc()
+func (c *Chain) providerLabel() string {
+	if c.provider == "" {
+		return "default"
+	}
+	return c.provider
+}
+
+func (c *Chain) RPCCall(method string, ok bool) {
+	c = c.or()
+	rpcCalls.WithLabelValues(c.name, c.providerLabel(), method, map[bool]string{true: "ok", false: "err"}[ok]).Inc()
 	if !ok {
-		atomic.StoreInt64(&lastRPCErrUnix, time.Now().Unix())
+		c.RPCUnavailable()
 	}
 }
 
-func ReceiptsInFlight(n int) {
-	inflightReceipts.Set(float64(n))
+// RPCRetry counts a retried attempt of a Client method.
+func (c *Chain) RPCRetry(method string) {
+	rpcRetries.WithLabelValues(c.Name(), method).Inc()
+}
+
+// RPCThrottled counts a rate-limit answer of the provider.
+func (c *Chain) RPCThrottled(method string) {
+	c = c.or()
+	rpcThrottled.WithLabelValues(c.name, c.providerLabel(), method).Inc()
 }
 
-func ObserveReceiptBatch(size int) {
+// SetRPCLimit exports the current value of an adaptive limit, such as the batch size.
+func (c *Chain) SetRPCLimit(limit string, v int) {
+	c = c.or()
+	rpcLimit.WithLabelValues(c.name, c.providerLabel(), limit).Set(float64(v))
+}
+
+func (c *Chain) RPCUnavailable() {
+	atomic.StoreInt64(&c.or().lastRPCErrUnix, time.Now().Unix())
+}
+
+// RPCFailover counts a call moved away from provider after it failed.
+func (c *Chain) RPCFailover(provider string) {
+	rpcFailovers.WithLabelValues(c.Name(), provider).Inc()
+}
+
+func (c *Chain) SetProviderHealth(provider string, healthy bool, head uint64) {
+	v := 0.0
+	if healthy {
+		v = 1
+	}
+	providerHealthy.WithLabelValues(c.Name(), provider).Set(v)
+	providerHead.WithLabelValues(c.Name(), provider).Set(float64(head))
+}
+
+func (c *Chain) ReceiptsInFlight(n int) {
+	inflightReceipts.WithLabelValues(c.Name()).Set(float64(n))
+}
+
+// ReceiptStrategy counts how a block's receipts were fetched: "block", "batch" or "single".
+func (c *Chain) ReceiptStrategy(strategy string) {
+	receiptFetches.WithLabelValues(c.Name(), strategy).Inc()
+}
+
+func (c *Chain) ObserveReceiptBatch(size int) {
 	if size > 0 {
-		receiptBatchSize.Observe(float64(size))
+		receiptBatchSize.WithLabelValues(c.Name()).Observe(float64(size))
 	}
 }
 
-func updateLag() {
-	h := headBlock.Desc() // sentinel to avoid unused; actual lag computed by reading gauge values below (kept simple here).
-	_ = h
-	// We can’t read gauge values directly; recompute from last seen head/finalized by storing numbers here if needed.
+// FinalityLag records how far behind the head the finality strategy puts the final block.
+func (c *Chain) FinalityLag(strategy string, lag uint64) {
+	finalityLag.WithLabelValues(c.Name(), strategy).Set(float64(lag))
 }
 
-func IsHealthy(now time.Time) (ok bool, reason string) {
-	headAge := now.Sub(time.Unix(atomic.LoadInt64(&lastHeadUnix), 0))
-	finalAge := now.Sub(time.Unix(atomic.LoadInt64(&lastFinalizedUnix), 0))
-	rpcErrAge := now.Sub(time.Unix(atomic.LoadInt64(&lastRPCErrUnix), 0))
-	ws := atomic.LoadUint32(&wsUp) == 1
+func (c *Chain) updateLag() {
+	head, fin := atomic.LoadUint64(&c.head), atomic.LoadUint64(&c.finalized)
+	if head >= fin && fin > 0 {
+		lagBlocks.WithLabelValues(c.name).Set(float64(head - fin))
+	}
+}
+
+// BackfillProgress exports the last committed backfill block, the target and the ETA.
+func (c *Chain) BackfillProgress(committed, target uint64, blocksPerSec float64, eta time.Duration) {
+	name := c.Name()
+	backfillCommitted.WithLabelValues(name).Set(float64(committed))
+	backfillTarget.WithLabelValues(name).Set(float64(target))
+	backfillRate.WithLabelValues(name).Set(blocksPerSec)
+	backfillETA.WithLabelValues(name).Set(eta.Seconds())
+}
+
+func SetAddressesTracked(n int) {
+	addressesTracked.Set(float64(n))
+}
 
+func AddressReload(ok bool) {
+	addressReloads.WithLabelValues(map[bool]string{true: "ok", false: "err"}[ok]).Inc()
+}
+
+func AddressesChanged(added, removed int) {
+	addressesAdded.Add(float64(added))
+	addressesRemoved.Add(float64(removed))
+}
+
+func PublishRetry(topic string) {
+	publishRetries.WithLabelValues(topic).Inc()
+}
+
+// DeadLettered counts an event handed to a dead-letter sink.
+func DeadLettered(sink string, ok bool) {
+	deadLettered.WithLabelValues(sink, map[bool]string{true: "ok", false: "err"}[ok]).Inc()
+}
+
+func (c *Chain) healthy(now time.Time) (ok bool, reason string) {
+	headAge := now.Sub(time.Unix(atomic.LoadInt64(&c.lastHeadUnix), 0))
+	finalAge := now.Sub(time.Unix(atomic.LoadInt64(&c.lastFinalizedUnix), 0))
+	rpcErrAge := now.Sub(time.Unix(atomic.LoadInt64(&c.lastRPCErrUnix), 0))
+	ws := atomic.LoadUint32(&c.wsUp) == 1
+
+	if atomic.LoadUint32(&c.halted) == 1 {
+		return false, "halted on a reorg deeper than the window"
+	}
+	if reason, _ := c.stopped.Load().(string); reason != "" {
+		return false, "stopped: " + reason
+	}
 	// simple SLOs (tweak as needed)
 	if headAge > 2*time.Minute && !ws {
 		return false, "no heads for >2m and WS down"
@@ -141,6 +380,30 @@ func IsHealthy(now time.Time) (ok bool, reason string) {
 	if rpcErrAge < 30*time.Second {
 		return false, "recent rpc errors"
 	}
+	c.stuckMu.Lock()
+	stuck, stuckSince := c.stuck, time.Unix(c.stuckSinceUnix, 0)
+	c.stuckMu.Unlock()
+	if stuck != 0 && now.Sub(stuckSince) > 2*time.Minute {
+		return false, fmt.Sprintf("block %d undelivered for >2m", stuck)
+	}
+
+	return true, "ok"
+}
 
+// IsHealthy reports whether every chain registered with ForChain is healthy.
+func IsHealthy(now time.Time) (ok bool, reason string) {
+	chainsMu.Lock()
+	names := make([]string, 0, len(chains))
+	for name := range chains {
+		names = append(names, name)
+	}
+	chainsMu.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		if ok, reason := ForChain(name).healthy(now); !ok {
+			return false, name + ": " + reason
+		}
+	}
 	return true, "ok"
 }
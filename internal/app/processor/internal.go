@@ -0,0 +1,113 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/ARK21/deblock/internal/app/kafka"
+	"github.com/ARK21/deblock/internal/app/rpc"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// valueFrames are the frame types that actually move ETH between accounts.
+// DELEGATECALL carries its caller's value and CALLCODE pays the caller itself.
+var valueFrames = map[string]bool{
+	"CALL":         true,
+	"CREATE":       true,
+	"CREATE2":      true,
+	"SELFDESTRUCT": true,
+}
+
+// fetchFrames traces blk. If no provider can trace it, it logs and returns no
+// frames, so the block is still handled like a non-traced one; any other error
+// is returned and the block is retried.
+func (s *Service) fetchFrames(ctx context.Context, blk rpc.Block) ([]rpc.TraceFrame, error) {
+	frames, err := s.RPC.TraceBlock(ctx, blk.Number, blk.Hash)
+	if errors.Is(err, rpc.ErrTracesUnavailable) {
+		log.Printf("trace block %d: %v, internal transfers skipped", blk.Number, err)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("trace block %d: %w", blk.Number, err)
+	}
+	return frames, nil
+}
+
+// publishInternalTransfers emits events for value-bearing sub-calls touching tracked
+// addresses and returns the number of matched frames.
+func (s *Service) publishInternalTransfers(ctx context.Context, p *Prepared, reorged bool) (int, error) {
+	matcher, blk, frames := p.matcher, p.Block, p.frames
+	// Frames arrive depth-first, so a reverted frame is always seen before its sub-calls.
+	failed := make(map[string]bool)
+	matched := 0
+	for _, f := range frames {
+		key := fmt.Sprintf("%d/%v", f.TxIndex, f.Path)
+		parent := ""
+		if len(f.Path) > 0 {
+			parent = fmt.Sprintf("%d/%v", f.TxIndex, f.Path[:len(f.Path)-1])
+		}
+		if f.Error != "" || (parent != "" && failed[parent]) {
+			failed[key] = true
+			continue
+		}
+		// the top-level frame is the tx itself, already covered by ProcessBlock
+		if len(f.Path) == 0 || !valueFrames[f.Type] {
+			continue
+		}
+		amountWei := strToBig(f.Value)
+		if amountWei.Sign() <= 0 {
+			continue
+		}
+		fromA, toA := common.HexToAddress(f.From), common.HexToAddress(f.To)
+		fromE, toE, ok := matcher.MatchAddresses(fromA, &toA)
+		if !ok {
+			continue
+		}
+		matched++
+
+		txHash := f.TxHash
+		if txHash == "" && f.TxIndex < len(blk.Txs) {
+			txHash = blk.Txs[f.TxIndex].Hash
+		}
+		from, to := fromA.Hex(), toA.Hex()
+		for _, side := range []struct {
+			e         filter.Entry
+			addr, dir string
+		}{
+			{toE, to, "in"},
+			{fromE, from, "out"},
+		} {
+			if side.e.UserID == "" {
+				continue
+			}
+			if err := s.emit(ctx, p, kafka.MatchedTxEvent{
+				Header:      s.header("MatchedTxEvent", blk, txHash, kafka.TracePath(f.Path), side.e.UserID, side.dir),
+				UserID:      side.e.UserID,
+				Address:     side.addr,
+				Direction:   side.dir,
+				TxHash:      txHash,
+				BlockNumber: blk.Number,
+				BlockTime:   int64(blk.Timestamp),
+				From:        from,
+				To:          to,
+				Label:       side.e.Label,
+				Tags:        side.e.Tags,
+				AmountWei:   amountWei.String(),
+				AmountEth:   weiToEth(amountWei),
+				FeeWei:      "0",
+				FeeEth:      "0",
+				Status:      "success",
+				ChainID:     s.ChainID,
+				Reorged:     reorged,
+				Internal:    true,
+				TracePath:   f.Path,
+			}); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return matched, nil
+}
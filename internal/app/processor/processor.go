@@ -2,6 +2,8 @@ package processor
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
 	"math/big"
 	"sync"
@@ -16,12 +18,33 @@ import (
 
 type Service struct {
 	RPC      rpc.Client
-	Matcher  *filter.Matcher
+	Matcher  filter.Provider
 	EventBus kafka.Publisher
 	ChainID  uint64
+	// Tokens enables ERC-20/721/1155 transfer decoding. It needs the receipt of every
+	// tx in the block, not only of those matched on from/to.
+	Tokens bool
+	// Traces enables internal ETH transfers from call traces.
+	Traces bool
+	// BlockReceipts means the provider supports eth_getBlockReceipts, so receipts
+	// of many txs of a block are fetched in one call.
+	BlockReceipts bool
+	// DeliverBackoff is the first wait of Deliver between attempts at a block;
+	// it doubles up to 30s. Zero means 1s.
+	DeliverBackoff time.Duration
+	// OnDelivered, if set, gets every delivered block with the events it got, so
+	// they can be retracted if a reorg orphans the block.
+	OnDelivered func(blk rpc.Block, events []kafka.Emitted)
+	Metrics     *metrics.Chain
 }
 
-func NewService(rpcClient rpc.Client, matcher *filter.Matcher, eventBus kafka.Publisher, chainID uint64) *Service {
+// blockReceiptsShare is the share of a block's txs from which fetching all of
+// the block's receipts beats fetching the needed ones by hash.
+const blockReceiptsShare = 0.2
+
+const deliverBackoffCeil = 30 * time.Second
+
+func NewService(rpcClient rpc.Client, matcher filter.Provider, eventBus kafka.Publisher, chainID uint64) *Service {
 	if rpcClient == nil {
 		panic("RPC client cannot be nil")
 	}
@@ -40,74 +63,178 @@ func NewService(rpcClient rpc.Client, matcher *filter.Matcher, eventBus kafka.Pu
 	}
 }
 
+// match is a top-level tx touching tracked addresses.
+type match struct {
+	tx       rpc.Tx
+	from, to common.Address
+	hasTo    bool
+	in       filter.Entry
+	out      filter.Entry
+}
+
+// Prepared is a block together with everything its events need from the node.
+// Prepare can run for several blocks concurrently; Publish emits them in order.
+type Prepared struct {
+	Block rpc.Block
+	// one Matcher for the whole block, even if the address set is swapped meanwhile
+	matcher  *filter.Matcher
+	matches  []match
+	receipts map[string]rpc.Receipt
+	frames   []rpc.TraceFrame
+	emitted  []kafka.Emitted
+}
+
+// ProcessBlock prepares and publishes blk. It is all-or-nothing: an error means
+// some event of blk may not have been delivered and the whole block must be retried.
+// Retrying is safe, as event IDs are the same every time.
 func (s *Service) ProcessBlock(ctx context.Context, blk rpc.Block, reorged bool) (int, error) {
-	type match struct {
-		tx  rpc.Tx
-		in  string
-		out string
+	p, err := s.Prepare(ctx, blk)
+	if err != nil {
+		return 0, err
+	}
+	return s.Publish(ctx, p, reorged)
+}
+
+// Deliver publishes p, or blk when p is nil, retrying the whole block with backoff
+// until every event is delivered or ctx is done.
+func (s *Service) Deliver(ctx context.Context, blk rpc.Block, p *Prepared, reorged bool) (int, error) {
+	var matched int
+	err := s.retry(ctx, fmt.Sprintf("block %d", blk.Number), func() error {
+		var err error
+		if p == nil {
+			if p, err = s.Prepare(ctx, blk); err != nil {
+				return err
+			}
+		}
+		if matched, err = s.Publish(ctx, p, reorged); err != nil {
+			p = nil
+		}
+		return err
+	})
+	return matched, err
+}
+
+// Retract publishes a TxRetractedEvent for each of events, retrying with backoff
+// until all are delivered or ctx is done.
+func (s *Service) Retract(ctx context.Context, events []kafka.Emitted) error {
+	return s.retry(ctx, "retractions", func() error {
+		for _, e := range events {
+			if err := s.emit(ctx, nil, kafka.NewTxRetractedEvent(e)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Emit publishes an event that isn't tied to a tracked user, such as a reorg notice,
+// retrying with backoff until it is delivered or ctx is done.
+func (s *Service) Emit(ctx context.Context, event any) error {
+	return s.retry(ctx, fmt.Sprintf("%T", event), func() error {
+		return s.emit(ctx, nil, event)
+	})
+}
+
+// retry calls fn until it succeeds, backing off from DeliverBackoff up to 30s.
+func (s *Service) retry(ctx context.Context, what string, fn func() error) error {
+	backoff := s.DeliverBackoff
+	if backoff <= 0 {
+		backoff = time.Second
 	}
-	var ms []match
+	for {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("%s not delivered, retrying in %s: %v", what, backoff, err)
+		t := time.NewTimer(backoff)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+		backoff = min(2*backoff, deliverBackoffCeil)
+	}
+}
+
+// Prepare matches blk and fetches the receipts and traces its events need. It publishes nothing.
+// It fails if any needed receipt can't be fetched.
+func (s *Service) Prepare(ctx context.Context, blk rpc.Block) (p *Prepared, err error) {
+	defer func() {
+		if err != nil && ctx.Err() == nil {
+			s.Metrics.BlockFailed(blk.Number)
+		}
+	}()
+
+	p = &Prepared{Block: blk, matcher: s.Matcher.Current()}
 	for _, tx := range blk.Txs {
-		fromUID, toUID, ok := s.Matcher.Match(tx.From, tx.To)
+		// parsed once per tx; the matcher and the event reuse it
+		m := match{tx: tx, from: common.HexToAddress(tx.From)}
+		var to *common.Address
+		if tx.To != nil {
+			m.to, m.hasTo = common.HexToAddress(*tx.To), true
+			to = &m.to
+		}
+		fromE, toE, ok := p.matcher.MatchAddresses(m.from, to)
 		if !ok {
 			continue
 		}
-		ms = append(ms, match{tx: tx, in: toUID, out: fromUID})
-	}
-	if len(ms) == 0 {
-		return 0, nil
+		m.in, m.out = toE, fromE
+		p.matches = append(p.matches, m)
 	}
 
 	//Batch receipts
-	hashes := make([]string, len(ms))
-	seen := make(map[string]struct{}, len(ms))
-	for _, m := range ms {
-		if _, ok := seen[m.tx.Hash]; !ok {
-			seen[m.tx.Hash] = struct{}{}
-			hashes = append(hashes, m.tx.Hash)
+	hashes := make([]string, 0, len(p.matches))
+	if s.Tokens {
+		for _, tx := range blk.Txs {
+			hashes = append(hashes, tx.Hash)
+		}
+	} else {
+		seen := make(map[string]struct{}, len(p.matches))
+		for _, m := range p.matches {
+			if _, ok := seen[m.tx.Hash]; !ok {
+				seen[m.tx.Hash] = struct{}{}
+				hashes = append(hashes, m.tx.Hash)
+			}
+		}
+	}
+	if s.Traces {
+		if p.frames, err = s.fetchFrames(ctx, blk); err != nil {
+			return nil, err
 		}
 	}
+	if len(hashes) > 0 {
+		if p.receipts, err = s.fetchReceipts(ctx, blk, hashes); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
 
-	ctxTO, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
-	receipts, err := s.RPC.BatchGetReceipts(ctxTO, hashes)
+// Publish emits the events of a prepared block and returns the number of matches.
+// It stops at the first event that isn't delivered.
+func (s *Service) Publish(ctx context.Context, p *Prepared, reorged bool) (int, error) {
+	blk, receipts := p.Block, p.receipts
+	p.emitted = nil
+	internal, err := s.publishInternalTransfers(ctx, p, reorged)
 	if err != nil {
-		// fallback (rare): fetch individually with small concurrency
-		receipts = make(map[string]rpc.Receipt, len(hashes))
-		sem := make(chan struct{}, 8) // limit concurrency to 10
-		var mu sync.Mutex
-		var wg sync.WaitGroup
-		for _, hash := range hashes {
-			wg.Add(1)
-			sem <- struct{}{}
-			go func(h string) {
-				defer wg.Done()
-				defer func() { <-sem }()
-				rctx, cc := context.WithTimeout(ctxTO, 5*time.Second)
-				defer cc()
-				if r, e := s.RPC.GetTxReceipt(rctx, h); e == nil {
-					mu.Lock()
-					receipts[h] = r
-					mu.Unlock()
-				} else {
-					log.Printf("failed to get receipt for %s: %v", h, e)
-				}
-			}(hash)
-		}
-		wg.Wait()
-	}
-
-	for _, m := range ms {
+		return 0, s.failed(ctx, blk, err)
+	}
+
+	for _, m := range p.matches {
 		rcpt, ok := receipts[m.tx.Hash]
 		if !ok {
-			log.Printf("no receipt for tx %s in block %d", m.tx.Hash, blk.Number)
-			continue
+			return 0, s.failed(ctx, blk, fmt.Errorf("no receipt for tx %s", m.tx.Hash))
 		}
 
-		from := common.HexToAddress(m.tx.From).Hex()
+		from := m.from.Hex()
 		to := ""
-		if m.tx.To != nil {
-			to = common.HexToAddress(*m.tx.To).Hex()
+		if m.hasTo {
+			to = m.to.Hex()
 		}
 
 		amountWei := strToBig(m.tx.Value)
@@ -122,13 +249,12 @@ func (s *Service) ProcessBlock(ctx context.Context, blk rpc.Block, reorged bool)
 		if rcpt.Status == 1 {
 			status = "success"
 		}
-		published := 0
 
 		// Emit for incoming
-		if m.in != "" {
-			if err = s.EventBus.Publish(ctx, kafka.MatchedTxEvent{
-				Header:      kafka.NewMessageHeader("MatchedTxEvent"),
-				UserID:      m.in,
+		if m.in.UserID != "" {
+			if err := s.emit(ctx, p, kafka.MatchedTxEvent{
+				Header:      s.header("MatchedTxEvent", blk, m.tx.Hash, "", m.in.UserID, "in"),
+				UserID:      m.in.UserID,
 				Address:     to,
 				Direction:   "in",
 				TxHash:      m.tx.Hash,
@@ -136,6 +262,8 @@ func (s *Service) ProcessBlock(ctx context.Context, blk rpc.Block, reorged bool)
 				BlockTime:   int64(blk.Timestamp),
 				From:        from,
 				To:          to,
+				Label:       m.in.Label,
+				Tags:        m.in.Tags,
 				AmountWei:   amountWei.String(),
 				AmountEth:   weiToEth(amountWei),
 				FeeWei:      "0",
@@ -144,16 +272,15 @@ func (s *Service) ProcessBlock(ctx context.Context, blk rpc.Block, reorged bool)
 				ChainID:     s.ChainID,
 				Reorged:     reorged,
 			}); err != nil {
-				log.Printf("failed to publish event: %v", err)
+				return 0, s.failed(ctx, blk, err)
 			}
-			published++
 		}
 
 		// Emit for outgoing
-		if m.out != "" {
-			if err = s.EventBus.Publish(ctx, kafka.MatchedTxEvent{
-				Header:      kafka.NewMessageHeader("MatchedTxEvent"),
-				UserID:      m.out,
+		if m.out.UserID != "" {
+			if err := s.emit(ctx, p, kafka.MatchedTxEvent{
+				Header:      s.header("MatchedTxEvent", blk, m.tx.Hash, "", m.out.UserID, "out"),
+				UserID:      m.out.UserID,
 				Address:     from,
 				Direction:   "out",
 				TxHash:      m.tx.Hash,
@@ -161,6 +288,8 @@ func (s *Service) ProcessBlock(ctx context.Context, blk rpc.Block, reorged bool)
 				BlockTime:   int64(blk.Timestamp),
 				From:        from,
 				To:          to,
+				Label:       m.out.Label,
+				Tags:        m.out.Tags,
 				AmountWei:   amountWei.String(),
 				AmountEth:   weiToEth(amountWei),
 				FeeWei:      feeWei.String(),
@@ -169,13 +298,132 @@ func (s *Service) ProcessBlock(ctx context.Context, blk rpc.Block, reorged bool)
 				ChainID:     s.ChainID,
 				Reorged:     reorged,
 			}); err != nil {
-				log.Printf("failed to publish event: %v", err)
+				return 0, s.failed(ctx, blk, err)
 			}
-			published++
 		}
-		metrics.AddEventsPublished(published)
 	}
-	return len(ms), nil
+
+	matched := len(p.matches) + internal
+	if s.Tokens {
+		tokens, err := s.publishTokenTransfers(ctx, p, reorged)
+		if err != nil {
+			return 0, s.failed(ctx, blk, err)
+		}
+		matched += tokens
+	}
+	s.Metrics.BlockDelivered(blk.Number)
+	if s.OnDelivered != nil {
+		s.OnDelivered(blk, p.emitted)
+	}
+	return matched, nil
+}
+
+// emit publishes one event and, with p set, keeps its record in p. An event
+// dead-lettered to the DLQ topic counts as delivered, it can be redriven from
+// there; one only held in the local DLQ file fails the block, so the checkpoint
+// doesn't move past it.
+func (s *Service) emit(ctx context.Context, p *Prepared, event any) error {
+	err := s.EventBus.Publish(ctx, event)
+	if errors.Is(err, kafka.ErrDeadLettered) && !errors.Is(err, kafka.ErrDeadLetteredLocally) {
+		log.Printf("publish: %v", err)
+		err = nil
+	} else if err == nil {
+		s.Metrics.AddEventsPublished(1)
+	}
+	if err != nil {
+		return err
+	}
+	if p != nil {
+		if e, ok := kafka.Emission(event); ok {
+			p.emitted = append(p.emitted, e)
+		}
+	}
+	return nil
+}
+
+// failed records that blk wasn't delivered and returns err with the block number.
+func (s *Service) failed(ctx context.Context, blk rpc.Block, err error) error {
+	if ctx.Err() == nil {
+		s.Metrics.BlockFailed(blk.Number)
+	}
+	return fmt.Errorf("block %d: %w", blk.Number, err)
+}
+
+// header derives the event ID from the fact it reports, so reprocessing blk yields the same IDs.
+func (s *Service) header(eventName string, blk rpc.Block, txHash, index, userID, dir string) kafka.MessageHeader {
+	return kafka.NewEventHeader(eventName, kafka.EventKey{
+		ChainID:   s.ChainID,
+		BlockHash: blk.Hash,
+		TxHash:    txHash,
+		Index:     index,
+		UserID:    userID,
+		Direction: dir,
+	})
+}
+
+// fetchReceipts gets the receipts of hashes, which are txs of blk. It takes the whole
+// block's receipts when the provider supports it and enough of the block is needed,
+// batches receipt calls otherwise, and falls back to individual calls when the batch fails.
+// It fails if any receipt is still missing.
+func (s *Service) fetchReceipts(ctx context.Context, blk rpc.Block, hashes []string) (map[string]rpc.Receipt, error) {
+	if s.BlockReceipts && float64(len(hashes)) >= blockReceiptsShare*float64(len(blk.Txs)) {
+		receipts, err := s.RPC.GetBlockReceipts(ctx, blk.Hash)
+		if err == nil {
+			err = complete(receipts, hashes)
+		}
+		if err == nil {
+			s.Metrics.ReceiptStrategy("block")
+			return receipts, nil
+		}
+		log.Printf("block receipts for %d failed, batching instead: %v", blk.Number, err)
+	}
+
+	receipts, err := s.RPC.BatchGetReceipts(ctx, hashes)
+	if err == nil {
+		err = complete(receipts, hashes)
+	}
+	if err == nil {
+		s.Metrics.ReceiptStrategy("batch")
+		return receipts, nil
+	}
+	s.Metrics.ReceiptStrategy("single")
+
+	// fallback (rare): fetch individually with the concurrency the provider currently allows
+	receipts = make(map[string]rpc.Receipt, len(hashes))
+	sem := make(chan struct{}, rpc.Parallelism(s.RPC))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, hash := range hashes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(h string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if r, e := s.RPC.GetTxReceipt(ctx, h); e == nil {
+				mu.Lock()
+				receipts[h] = r
+				mu.Unlock()
+			} else {
+				log.Printf("failed to get receipt for %s: %v", h, e)
+			}
+		}(hash)
+	}
+	wg.Wait()
+	return receipts, complete(receipts, hashes)
+}
+
+// complete fails if receipts lacks any of hashes.
+func complete(receipts map[string]rpc.Receipt, hashes []string) error {
+	missing := 0
+	for _, h := range hashes {
+		if _, ok := receipts[h]; !ok {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d of %d receipts missing", missing, len(hashes))
+	}
+	return nil
 }
 
 func weiToEth(wei *big.Int) string {
@@ -189,24 +437,6 @@ func weiToEth(wei *big.Int) string {
 	return r.FloatString(18)
 }
 
-func getReceiptWithTRetry(ctx context.Context, c rpc.Client, hash string, n int, backoff time.Duration) (rpc.Receipt, error) {
-	var rr rpc.Receipt
-	var err error
-	for i := 0; i < n; i++ {
-		rr, err = c.GetTxReceipt(ctx, hash)
-		if err == nil {
-			return rr, nil
-		}
-		select {
-		case <-ctx.Done():
-			return rr, ctx.Err()
-		case <-time.After(backoff):
-			backoff = backoff * 2
-		}
-	}
-	return rr, err
-}
-
 func strToBig(s string) *big.Int {
 	if s == "" {
 		return big.NewInt(0)
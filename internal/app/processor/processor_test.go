@@ -2,6 +2,7 @@ package processor
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/big"
 	"testing"
@@ -9,6 +10,7 @@ import (
 	"github.com/ARK21/deblock/internal/app/filter"
 	"github.com/ARK21/deblock/internal/app/kafka"
 	"github.com/ARK21/deblock/internal/app/rpc"
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/stretchr/testify/require"
 )
 
@@ -22,7 +24,12 @@ func TestWeiToEth(t *testing.T) {
 }
 
 // ---- capture bus to collect events ----
-type captureBus struct{ out []kafka.MatchedTxEvent }
+type captureBus struct {
+	out     []kafka.MatchedTxEvent
+	tokens  []kafka.TokenTransferEvent
+	erc721  []kafka.ERC721TransferEvent
+	erc1155 []kafka.ERC1155TransferEvent
+}
 
 var _ kafka.Publisher = (*captureBus)(nil)
 
@@ -32,6 +39,12 @@ func (c *captureBus) Publish(_ context.Context, event any) error {
 		c.out = append(c.out, e)
 	case *kafka.MatchedTxEvent:
 		c.out = append(c.out, *e)
+	case kafka.TokenTransferEvent:
+		c.tokens = append(c.tokens, e)
+	case kafka.ERC721TransferEvent:
+		c.erc721 = append(c.erc721, e)
+	case kafka.ERC1155TransferEvent:
+		c.erc1155 = append(c.erc1155, e)
 	default:
 		return fmt.Errorf("unexpected event type %T", event)
 	}
@@ -40,7 +53,19 @@ func (c *captureBus) Publish(_ context.Context, event any) error {
 
 // ---- mock RPC that returns receipts deterministically ----
 type mockRPC struct {
-	rc map[string]rpc.Receipt
+	rc     map[string]rpc.Receipt
+	frames []rpc.TraceFrame
+	// traceErr fails TraceBlock when set
+	traceErr error
+	// calls counts receipt fetches by strategy
+	calls map[string]int
+}
+
+func (m *mockRPC) count(strategy string) {
+	if m.calls == nil {
+		m.calls = make(map[string]int)
+	}
+	m.calls[strategy]++
 }
 
 func (m *mockRPC) SubscribeNewHeads(context.Context) (<-chan rpc.Header, <-chan error) {
@@ -52,14 +77,31 @@ func (m *mockRPC) GetBlockByHash(context.Context, string, bool) (rpc.Block, erro
 func (m *mockRPC) GetBlockByNumber(context.Context, uint64, bool) (rpc.Block, error) {
 	return rpc.Block{}, nil
 }
+func (m *mockRPC) GetBlockByTag(context.Context, string, bool) (rpc.Block, error) {
+	return rpc.Block{}, nil
+}
 func (m *mockRPC) GetTxReceipt(_ context.Context, h string) (rpc.Receipt, error) { return m.rc[h], nil }
 func (m *mockRPC) BatchGetReceipts(_ context.Context, hashes []string) (map[string]rpc.Receipt, error) {
+	m.count("batch")
 	out := make(map[string]rpc.Receipt, len(hashes))
 	for _, h := range hashes {
 		out[h] = m.rc[h]
 	}
 	return out, nil
 }
+func (m *mockRPC) GetBlockReceipts(context.Context, string) (map[string]rpc.Receipt, error) {
+	m.count("block")
+	return m.rc, nil
+}
+func (m *mockRPC) TraceBlock(context.Context, uint64, string) ([]rpc.TraceFrame, error) {
+	if m.traceErr != nil {
+		return nil, m.traceErr
+	}
+	if m.frames == nil {
+		return nil, rpc.ErrTracesUnavailable
+	}
+	return m.frames, nil
+}
 func (m *mockRPC) GetChainID(context.Context) (uint64, error)     { return 1, nil }
 func (m *mockRPC) GetBlockNumber(context.Context) (uint64, error) { return 0, nil }
 
@@ -128,3 +170,300 @@ func TestProcessBlock_EmitsInAndOut_WithFees(t *testing.T) {
 		require.False(t, e.Reorged)
 	}
 }
+
+func TestProcessBlock_EmitsTokenTransfers(t *testing.T) {
+	ctx := context.Background()
+
+	addrA := "0x0000000000000000000000000000000000000AaA" // user uA
+	usdt := "0xdAC17F958D2ee523a2206206994597C13D831ec7"
+	other := "0x0000000000000000000000000000000000000cCc"
+	matcher := filter.NewMatcher(map[string]string{addrA: "uA"})
+
+	// other calls usdt.transfer(A, 5_000_000): tx.to is the token contract, so
+	// nothing matches on from/to and only the log reveals the deposit.
+	blk := rpc.Block{
+		Number:    200,
+		Timestamp: 1710000000,
+		Txs: []rpc.Tx{
+			{Hash: "0xTX1", From: other, To: &usdt, Value: "0"},
+		},
+	}
+	topic := func(addr string) string { return common.BytesToHash(common.HexToAddress(addr).Bytes()).Hex() }
+	rc := map[string]rpc.Receipt{
+		"0xTX1": {Status: 1, GasUsed: "50000", EffectiveGasPrice: "1000000000", Logs: []rpc.Log{
+			{
+				Address: usdt,
+				Topics:  []string{transferSig.Hex(), topic(other), topic(addrA)},
+				Data:    common.BytesToHash(big.NewInt(5_000_000).Bytes()).Hex(),
+				Index:   7,
+			},
+			// unrelated log with too few topics must be ignored
+			{Address: usdt, Topics: []string{transferSig.Hex()}, Data: "0x", Index: 8},
+		}},
+	}
+
+	bus := &captureBus{}
+	s := &Service{RPC: &mockRPC{rc: rc}, Matcher: matcher, EventBus: bus, ChainID: 1, Tokens: true}
+
+	n, err := s.ProcessBlock(ctx, blk, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Empty(t, bus.out)
+	require.Len(t, bus.tokens, 1)
+
+	e := bus.tokens[0]
+	require.Equal(t, "uA", e.UserID)
+	require.Equal(t, "in", e.Direction)
+	require.Equal(t, common.HexToAddress(addrA).Hex(), e.Address)
+	require.Equal(t, usdt, e.Token)
+	require.Equal(t, "5000000", e.AmountRaw)
+	require.Equal(t, uint64(7), e.LogIndex)
+	require.Equal(t, uint64(0), e.TxLogIndex)
+
+	// a reorg moves the tx to another block, behind other txs' logs: same fact
+	rc["0xTX1"].Logs[0].Index = 42
+	blk.Number, blk.Hash = 201, "H201"
+	_, err = s.ProcessBlock(ctx, blk, true)
+	require.NoError(t, err)
+	require.Len(t, bus.tokens, 2)
+	require.Equal(t, e.Header.FactID, bus.tokens[1].Header.FactID)
+	require.NotEqual(t, e.Header.ID, bus.tokens[1].Header.ID)
+}
+
+func TestProcessBlock_EmitsInternalTransfers(t *testing.T) {
+	ctx := context.Background()
+
+	addrA := "0x0000000000000000000000000000000000000AaA" // user uA
+	addrB := "0x0000000000000000000000000000000000000BbB" // user uB
+	sender := "0x0000000000000000000000000000000000000cCc"
+	multisend := "0x0000000000000000000000000000000000000dDd"
+	matcher := filter.NewMatcher(map[string]string{addrA: "uA", addrB: "uB"})
+
+	blk := rpc.Block{
+		Number: 300,
+		Txs:    []rpc.Tx{{Hash: "0xTX1", From: sender, To: &multisend, Value: "3000"}},
+	}
+	frames := []rpc.TraceFrame{
+		{TxIndex: 0, Type: "CALL", From: sender, To: multisend, Value: "3000"},
+		{TxIndex: 0, Path: []int{0}, Type: "CALL", From: multisend, To: addrA, Value: "1000"},
+		// reverted sub-call and everything below it must be ignored
+		{TxIndex: 0, Path: []int{1}, Type: "CALL", From: multisend, To: sender, Value: "0", Error: "execution reverted"},
+		{TxIndex: 0, Path: []int{1, 0}, Type: "CALL", From: sender, To: addrB, Value: "2000"},
+		// delegatecall value belongs to its caller
+		{TxIndex: 0, Path: []int{2}, Type: "DELEGATECALL", From: multisend, To: addrB, Value: "3000"},
+	}
+
+	bus := &captureBus{}
+	s := &Service{RPC: &mockRPC{frames: frames}, Matcher: matcher, EventBus: bus, ChainID: 1, Traces: true}
+
+	n, err := s.ProcessBlock(ctx, blk, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Len(t, bus.out, 1)
+
+	e := bus.out[0]
+	require.Equal(t, "uA", e.UserID)
+	require.Equal(t, "in", e.Direction)
+	require.Equal(t, "0xTX1", e.TxHash)
+	require.Equal(t, "1000", e.AmountWei)
+	require.True(t, e.Internal)
+	require.Equal(t, []int{0}, e.TracePath)
+}
+
+func TestProcessBlock_TracesUnavailable(t *testing.T) {
+	addrA := "0x0000000000000000000000000000000000000AaA"
+	blk := rpc.Block{Number: 301, Txs: []rpc.Tx{{Hash: "0xTX1", From: addrA, Value: "1"}}}
+
+	bus := &captureBus{}
+	s := &Service{
+		RPC:      &mockRPC{rc: map[string]rpc.Receipt{"0xTX1": {Status: 1}}},
+		Matcher:  filter.NewMatcher(map[string]string{addrA: "uA"}),
+		EventBus: bus,
+		Traces:   true,
+	}
+
+	n, err := s.ProcessBlock(context.Background(), blk, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Len(t, bus.out, 1)
+	require.False(t, bus.out[0].Internal)
+}
+
+func TestProcessBlock_TraceFailureFailsBlock(t *testing.T) {
+	addrA := "0x0000000000000000000000000000000000000AaA"
+	blk := rpc.Block{Number: 302, Txs: []rpc.Tx{{Hash: "0xTX1", From: addrA, Value: "1"}}}
+
+	bus := &captureBus{}
+	s := &Service{
+		RPC:      &mockRPC{rc: map[string]rpc.Receipt{"0xTX1": {Status: 1}}, traceErr: errors.New("timeout")},
+		Matcher:  filter.NewMatcher(map[string]string{addrA: "uA"}),
+		EventBus: bus,
+		Traces:   true,
+	}
+
+	// a flaky trace must not drop the block's internal transfers
+	_, err := s.ProcessBlock(context.Background(), blk, false)
+	require.ErrorContains(t, err, "timeout")
+	require.Empty(t, bus.out)
+}
+
+func TestProcessBlock_EmitsNFTTransfers(t *testing.T) {
+	addrA := "0x0000000000000000000000000000000000000AaA" // user uA
+	other := "0x0000000000000000000000000000000000000cCc"
+	nft := "0x0000000000000000000000000000000000000dDd"
+	matcher := filter.NewMatcher(map[string]string{addrA: "uA"})
+
+	topic := func(addr string) string { return common.BytesToHash(common.HexToAddress(addr).Bytes()).Hex() }
+	word := func(n int64) string { return common.BigToHash(big.NewInt(n)).Hex()[2:] }
+
+	blk := rpc.Block{Number: 400, Txs: []rpc.Tx{{Hash: "0xTX1", From: other, To: &nft, Value: "0"}}}
+	rc := map[string]rpc.Receipt{
+		"0xTX1": {Status: 1, Logs: []rpc.Log{
+			// ERC-721: A sends token #42
+			{Address: nft, Topics: []string{transferSig.Hex(), topic(addrA), topic(other), word(42)}, Data: "0x", Index: 0},
+			// ERC-1155 single: operator moves 5 of #7 to A
+			{Address: nft, Topics: []string{transferSingleSig.Hex(), topic(other), topic(other), topic(addrA)}, Data: "0x" + word(7) + word(5), Index: 1},
+			// ERC-1155 batch: ids [1,2], values [10,20] to A
+			{Address: nft, Topics: []string{transferBatchSig.Hex(), topic(other), topic(other), topic(addrA)},
+				Data: "0x" + word(64) + word(160) + word(2) + word(1) + word(2) + word(2) + word(10) + word(20), Index: 2},
+		}},
+	}
+
+	bus := &captureBus{}
+	s := &Service{RPC: &mockRPC{rc: rc}, Matcher: matcher, EventBus: bus, ChainID: 1, Tokens: true}
+
+	n, err := s.ProcessBlock(context.Background(), blk, false)
+	require.NoError(t, err)
+	require.Equal(t, 3, n)
+
+	require.Len(t, bus.erc721, 1)
+	require.Equal(t, "out", bus.erc721[0].Direction)
+	require.Equal(t, "42", bus.erc721[0].TokenID)
+	require.Equal(t, common.HexToAddress(nft).Hex(), bus.erc721[0].Contract)
+
+	require.Len(t, bus.erc1155, 2)
+	single, batch := bus.erc1155[0], bus.erc1155[1]
+	require.Equal(t, "in", single.Direction)
+	require.Equal(t, common.HexToAddress(other).Hex(), single.Operator)
+	require.Equal(t, []string{"7"}, single.TokenIDs)
+	require.Equal(t, []string{"5"}, single.Quantities)
+	require.Equal(t, []string{"1", "2"}, batch.TokenIDs)
+	require.Equal(t, []string{"10", "20"}, batch.Quantities)
+	require.Equal(t, uint64(2), batch.LogIndex)
+}
+
+func TestProcessBlock_ReceiptStrategy(t *testing.T) {
+	ctx := context.Background()
+
+	addrA := "0x0000000000000000000000000000000000000AaA"
+	other := "0x0000000000000000000000000000000000000cCc"
+	matcher := filter.NewMatcher(map[string]string{addrA: "uA"})
+
+	// one tracked tx among ten
+	blk := rpc.Block{Number: 7, Hash: "H7"}
+	rc := map[string]rpc.Receipt{}
+	for i := 0; i < 10; i++ {
+		from := other
+		if i == 0 {
+			from = addrA
+		}
+		h := fmt.Sprintf("0xTX%d", i)
+		blk.Txs = append(blk.Txs, rpc.Tx{Hash: h, From: from, To: &other, Value: "1"})
+		rc[h] = rpc.Receipt{Status: 1, GasUsed: "21000", EffectiveGasPrice: "1"}
+	}
+
+	// few matches: per-hash batch even though block receipts are supported
+	rpcMock := &mockRPC{rc: rc}
+	s := &Service{RPC: rpcMock, Matcher: matcher, EventBus: &captureBus{}, ChainID: 1, BlockReceipts: true}
+	_, err := s.ProcessBlock(ctx, blk, false)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"batch": 1}, rpcMock.calls)
+
+	// token tracking needs every receipt: one call for the whole block
+	rpcMock = &mockRPC{rc: rc}
+	s = &Service{RPC: rpcMock, Matcher: matcher, EventBus: &captureBus{}, ChainID: 1, BlockReceipts: true, Tokens: true}
+	_, err = s.ProcessBlock(ctx, blk, false)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"block": 1}, rpcMock.calls)
+
+	// without provider support it stays batched
+	rpcMock = &mockRPC{rc: rc}
+	s = &Service{RPC: rpcMock, Matcher: matcher, EventBus: &captureBus{}, ChainID: 1, Tokens: true}
+	_, err = s.ProcessBlock(ctx, blk, false)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{"batch": 1}, rpcMock.calls)
+}
+
+func TestProcessBlock_DeterministicEventIDs(t *testing.T) {
+	ctx := context.Background()
+	addrA := "0x0000000000000000000000000000000000000AaA"
+	addrB := "0x0000000000000000000000000000000000000BbB"
+	matcher := filter.NewMatcher(map[string]string{addrA: "uA", addrB: "uB"})
+	blk := rpc.Block{
+		Number: 123,
+		Hash:   "H123",
+		Txs:    []rpc.Tx{{Hash: "0xTX1", From: addrA, To: &addrB, Value: "1"}},
+	}
+	rpcMock := &mockRPC{rc: map[string]rpc.Receipt{"0xTX1": {Status: 1}}}
+
+	run := func(blk rpc.Block, reorged bool) []kafka.MatchedTxEvent {
+		bus := &captureBus{}
+		s := &Service{RPC: rpcMock, Matcher: matcher, EventBus: bus, ChainID: 1}
+		_, err := s.ProcessBlock(ctx, blk, reorged)
+		require.NoError(t, err)
+		require.Len(t, bus.out, 2)
+		return bus.out
+	}
+
+	first := run(blk, false)
+	require.NotEqual(t, first[0].Header.ID, first[1].Header.ID)
+
+	// the same block again, e.g. after a restart, yields the same IDs
+	again := run(blk, true)
+	for i := range first {
+		require.Equal(t, first[i].Header.ID, again[i].Header.ID)
+		require.Equal(t, "H123", again[i].Header.BlockHash)
+	}
+
+	// the tx re-included in a block with another hash keeps its fact ID only
+	blk.Hash = "H123b"
+	moved := run(blk, true)
+	for i := range first {
+		require.NotEqual(t, first[i].Header.ID, moved[i].Header.ID)
+		require.Equal(t, first[i].Header.FactID, moved[i].Header.FactID)
+	}
+}
+
+// errBus fails every publish with err.
+type errBus struct{ err error }
+
+func (b errBus) Publish(context.Context, any) error { return b.err }
+
+func TestProcessBlock_AllOrNothing(t *testing.T) {
+	ctx := context.Background()
+	addrA := "0x0000000000000000000000000000000000000AaA"
+	addrB := "0x0000000000000000000000000000000000000BbB"
+	matcher := filter.NewMatcher(map[string]string{addrA: "uA"})
+	blk := rpc.Block{
+		Number: 5,
+		Hash:   "H5",
+		Txs:    []rpc.Tx{{Hash: "0xTX1", From: addrA, To: &addrB, Value: "1"}},
+	}
+	rpcMock := &mockRPC{rc: map[string]rpc.Receipt{"0xTX1": {Status: 1}}}
+
+	// an undelivered event fails the block
+	s := &Service{RPC: rpcMock, Matcher: matcher, EventBus: errBus{errors.New("broker down")}, ChainID: 1}
+	_, err := s.ProcessBlock(ctx, blk, false)
+	require.ErrorContains(t, err, "broker down")
+
+	// a dead-lettered event is kept for redrive, so the block is done
+	s.EventBus = errBus{kafka.ErrDeadLettered}
+	n, err := s.ProcessBlock(ctx, blk, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	// one only in the local DLQ file isn't in Kafka yet: the block is retried
+	s.EventBus = errBus{fmt.Errorf("%w, %w", kafka.ErrDeadLettered, kafka.ErrDeadLetteredLocally)}
+	_, err = s.ProcessBlock(ctx, blk, false)
+	require.ErrorIs(t, err, kafka.ErrDeadLetteredLocally)
+}
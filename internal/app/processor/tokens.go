@@ -0,0 +1,221 @@
+package processor
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ARK21/deblock/internal/app/kafka"
+	"github.com/ARK21/deblock/internal/app/rpc"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+var (
+	// transferSig is topic0 of Transfer(address,address,uint256). ERC-20 and ERC-721
+	// share it; ERC-721 indexes the token id, so it has 4 topics instead of 3.
+	transferSig       = crypto.Keccak256Hash([]byte("Transfer(address,address,uint256)"))
+	transferSingleSig = crypto.Keccak256Hash([]byte("TransferSingle(address,address,address,uint256,uint256)"))
+	transferBatchSig  = crypto.Keccak256Hash([]byte("TransferBatch(address,address,address,uint256[],uint256[])"))
+)
+
+const (
+	kindERC20   = "erc20"
+	kindERC721  = "erc721"
+	kindERC1155 = "erc1155"
+)
+
+// tokenTransfer is a decoded transfer log. For ERC-20 amounts holds the single
+// value; for ERC-721 ids holds the single token id; ERC-1155 uses both, index-aligned.
+// index is the log's index in the block and txIndex its position in the tx
+// receipt, which keys the fact.
+type tokenTransfer struct {
+	kind     string
+	token    string
+	operator common.Address
+	from     common.Address
+	to       common.Address
+	ids      []*big.Int
+	amounts  []*big.Int
+	index    uint64
+	txIndex  uint64
+}
+
+// decodeTransfer returns the transfer carried by l, if it is an ERC-20, ERC-721 or ERC-1155 transfer log.
+func decodeTransfer(l rpc.Log) (tokenTransfer, bool) {
+	if len(l.Topics) == 0 {
+		return tokenTransfer{}, false
+	}
+	tt := tokenTransfer{token: common.HexToAddress(l.Address).Hex(), index: l.Index}
+	data := common.FromHex(l.Data)
+
+	switch sig := common.HexToHash(l.Topics[0]); {
+	case sig == transferSig && len(l.Topics) == 3 && len(data) == 32:
+		tt.kind = kindERC20
+		tt.from, tt.to = topicToAddress(l.Topics[1]), topicToAddress(l.Topics[2])
+		tt.amounts = []*big.Int{new(big.Int).SetBytes(data)}
+	case sig == transferSig && len(l.Topics) == 4 && len(data) == 0:
+		tt.kind = kindERC721
+		tt.from, tt.to = topicToAddress(l.Topics[1]), topicToAddress(l.Topics[2])
+		tt.ids = []*big.Int{common.HexToHash(l.Topics[3]).Big()}
+	case sig == transferSingleSig && len(l.Topics) == 4 && len(data) == 64:
+		tt.kind = kindERC1155
+		tt.operator, tt.from, tt.to = topicToAddress(l.Topics[1]), topicToAddress(l.Topics[2]), topicToAddress(l.Topics[3])
+		tt.ids = []*big.Int{new(big.Int).SetBytes(data[:32])}
+		tt.amounts = []*big.Int{new(big.Int).SetBytes(data[32:])}
+	case sig == transferBatchSig && len(l.Topics) == 4:
+		ids, ok1 := abiUintArray(data, 0)
+		amounts, ok2 := abiUintArray(data, 1)
+		if !ok1 || !ok2 || len(ids) != len(amounts) {
+			return tokenTransfer{}, false
+		}
+		tt.kind = kindERC1155
+		tt.operator, tt.from, tt.to = topicToAddress(l.Topics[1]), topicToAddress(l.Topics[2]), topicToAddress(l.Topics[3])
+		tt.ids, tt.amounts = ids, amounts
+	default:
+		return tokenTransfer{}, false
+	}
+	return tt, true
+}
+
+func topicToAddress(topic string) common.Address {
+	return common.BytesToAddress(common.HexToHash(topic).Bytes())
+}
+
+// abiUintArray decodes the uint256[] referenced by the arg-th head word of ABI-encoded data.
+func abiUintArray(data []byte, arg int) ([]*big.Int, bool) {
+	word := func(off uint64) (*big.Int, bool) {
+		if off+32 > uint64(len(data)) || off+32 < off {
+			return nil, false
+		}
+		return new(big.Int).SetBytes(data[off : off+32]), true
+	}
+	head, ok := word(uint64(arg) * 32)
+	if !ok || !head.IsUint64() {
+		return nil, false
+	}
+	off := head.Uint64()
+	n, ok := word(off)
+	if !ok || !n.IsUint64() || n.Uint64() > uint64(len(data))/32 {
+		return nil, false
+	}
+	out := make([]*big.Int, n.Uint64())
+	for i := range out {
+		v, ok := word(off + 32 + uint64(i)*32)
+		if !ok {
+			return nil, false
+		}
+		out[i] = v
+	}
+	return out, true
+}
+
+// publishTokenTransfers emits an event per tracked side of every token transfer
+// log in the block and returns the number of matched transfers.
+func (s *Service) publishTokenTransfers(ctx context.Context, p *Prepared, reorged bool) (int, error) {
+	matcher, blk, receipts := p.matcher, p.Block, p.receipts
+	matched := 0
+	for _, tx := range blk.Txs {
+		rcpt, ok := receipts[tx.Hash]
+		if !ok {
+			continue
+		}
+		for i, l := range rcpt.Logs {
+			tt, ok := decodeTransfer(l)
+			if !ok {
+				continue
+			}
+			tt.txIndex = uint64(i)
+			fromE, toE, ok := matcher.MatchAddresses(tt.from, &tt.to)
+			if !ok {
+				continue
+			}
+			matched++
+			for _, side := range []struct {
+				uid  string
+				addr common.Address
+				dir  string
+			}{
+				{toE.UserID, tt.to, "in"},
+				{fromE.UserID, tt.from, "out"},
+			} {
+				if side.uid == "" {
+					continue
+				}
+				if err := s.emit(ctx, p, s.tokenEvent(blk, tx.Hash, tt, side.uid, side.addr.Hex(), side.dir, reorged)); err != nil {
+					return 0, fmt.Errorf("publish %s event: %w", tt.kind, err)
+				}
+			}
+		}
+	}
+	return matched, nil
+}
+
+func (s *Service) tokenEvent(blk rpc.Block, txHash string, tt tokenTransfer, uid, addr, dir string, reorged bool) any {
+	switch tt.kind {
+	case kindERC721:
+		return kafka.ERC721TransferEvent{
+			Header:      s.header("ERC721TransferEvent", blk, txHash, kafka.LogIndex(tt.txIndex), uid, dir),
+			UserID:      uid,
+			Address:     addr,
+			Direction:   dir,
+			TxHash:      txHash,
+			LogIndex:    tt.index,
+			TxLogIndex:  tt.txIndex,
+			BlockNumber: blk.Number,
+			BlockTime:   int64(blk.Timestamp),
+			Contract:    tt.token,
+			From:        tt.from.Hex(),
+			To:          tt.to.Hex(),
+			TokenID:     tt.ids[0].String(),
+			ChainID:     s.ChainID,
+			Reorged:     reorged,
+		}
+	case kindERC1155:
+		return kafka.ERC1155TransferEvent{
+			Header:      s.header("ERC1155TransferEvent", blk, txHash, kafka.LogIndex(tt.txIndex), uid, dir),
+			UserID:      uid,
+			Address:     addr,
+			Direction:   dir,
+			TxHash:      txHash,
+			LogIndex:    tt.index,
+			TxLogIndex:  tt.txIndex,
+			BlockNumber: blk.Number,
+			BlockTime:   int64(blk.Timestamp),
+			Contract:    tt.token,
+			Operator:    tt.operator.Hex(),
+			From:        tt.from.Hex(),
+			To:          tt.to.Hex(),
+			TokenIDs:    bigsToStrings(tt.ids),
+			Quantities:  bigsToStrings(tt.amounts),
+			ChainID:     s.ChainID,
+			Reorged:     reorged,
+		}
+	default:
+		return kafka.TokenTransferEvent{
+			Header:      s.header("TokenTransferEvent", blk, txHash, kafka.LogIndex(tt.txIndex), uid, dir),
+			UserID:      uid,
+			Address:     addr,
+			Direction:   dir,
+			TxHash:      txHash,
+			LogIndex:    tt.index,
+			TxLogIndex:  tt.txIndex,
+			BlockNumber: blk.Number,
+			BlockTime:   int64(blk.Timestamp),
+			Token:       tt.token,
+			From:        tt.from.Hex(),
+			To:          tt.to.Hex(),
+			AmountRaw:   tt.amounts[0].String(),
+			ChainID:     s.ChainID,
+			Reorged:     reorged,
+		}
+	}
+}
+
+func bigsToStrings(vs []*big.Int) []string {
+	out := make([]string, len(vs))
+	for i, v := range vs {
+		out[i] = v.String()
+	}
+	return out
+}
@@ -3,7 +3,10 @@ package reorg
 import (
 	"context"
 	"fmt"
+	"sort"
+	"time"
 
+	"github.com/ARK21/deblock/internal/app/kafka"
 	"github.com/ARK21/deblock/internal/app/rpc"
 )
 
@@ -12,6 +15,47 @@ type Manager struct {
 	// last processed canonical hashes by number (only keep a sliding window)
 	byNum   map[uint64]string
 	highest uint64
+	// events published for the blocks in byNum, to retract them after a reorg
+	events map[uint64][]kafka.Emitted
+
+	// DeepPolicy is what to do when no common ancestor is found within depth;
+	// see PolicyHalt, PolicyResync and PolicyWiden.
+	DeepPolicy string
+	// MaxSearch is how far back PolicyWiden walks; hashes are kept that far.
+	MaxSearch uint64
+	// LastDeep is the last reorg that reached below depth, if any.
+	LastDeep *DeepReorg
+	// Retracting holds the events of orphaned blocks until they are retracted.
+	Retracting *Retraction
+}
+
+// Retraction is the events orphaned by reorgs, due for retraction once the new
+// chain is re-processed through block Through.
+type Retraction struct {
+	Through uint64          `json:"through"`
+	Events  []kafka.Emitted `json:"events"`
+}
+
+// Policies for reorgs deeper than the window.
+const (
+	// PolicyHalt stops the chain and alerts.
+	PolicyHalt = "halt"
+	// PolicyResync reprocesses the window below the new block, retracting what it can.
+	PolicyResync = "resync"
+	// PolicyWiden searches MaxSearch blocks back for the ancestor, then halts.
+	PolicyWiden = "widen"
+)
+
+// DeepReorg records a reorg that reached below the window and how it was handled.
+type DeepReorg struct {
+	BlockNumber uint64 `json:"block_number"`
+	BlockHash   string `json:"block_hash"`
+	Policy      string `json:"policy"`
+	// Outcome is "halted", "resynced" or "widened".
+	Outcome        string    `json:"outcome"`
+	AncestorNumber uint64    `json:"ancestor_number,omitempty"`
+	ResyncFrom     uint64    `json:"resync_from,omitempty"`
+	At             time.Time `json:"at"`
 }
 
 func NewManager(depth int) *Manager {
@@ -22,6 +66,7 @@ func NewManager(depth int) *Manager {
 		depth:   uint64(depth),
 		byNum:   make(map[uint64]string, depth+2),
 		highest: 0,
+		events:  make(map[uint64][]kafka.Emitted, depth+2),
 	}
 }
 
@@ -45,17 +90,52 @@ func (m *Manager) Record(blk rpc.Block) {
 		m.highest = blk.Number
 	}
 	// prune older than window
+	keep := m.depth
+	if m.DeepPolicy == PolicyWiden {
+		keep = max(keep, m.MaxSearch)
+	}
 	lower := uint64(0)
-	if m.highest > m.depth {
-		lower = m.highest - m.depth
+	if m.highest > keep {
+		lower = m.highest - keep
 	}
 	for n := range m.byNum {
 		if n < lower {
 			delete(m.byNum, n)
+			delete(m.events, n)
 		}
 	}
 }
 
+// Remember stores the events published for blk. It fits processor.Service.OnDelivered.
+func (m *Manager) Remember(blk rpc.Block, events []kafka.Emitted) {
+	if len(events) == 0 {
+		delete(m.events, blk.Number)
+		return
+	}
+	m.events[blk.Number] = events
+}
+
+// Vanished returns the orphaned events whose fact wasn't published again for the
+// blocks recorded since, i.e. the ones to retract.
+func (m *Manager) Vanished(orphaned []kafka.Emitted) []kafka.Emitted {
+	if len(orphaned) == 0 {
+		return nil
+	}
+	facts := make(map[string]bool)
+	for _, evs := range m.events {
+		for _, e := range evs {
+			facts[e.FactID] = true
+		}
+	}
+	var out []kafka.Emitted
+	for _, e := range orphaned {
+		if !facts[e.FactID] {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
 // CommonAncestor walks up the *new* chain from head (by following parent hashes)
 // until it finds a block number within our window whose hash equals what we recorded.
 // Returns (number, hash, found).
@@ -64,6 +144,17 @@ func (m *Manager) CommonAncestor(
 	c rpc.Client,
 	headHash string,
 	headNum uint64,
+) (uint64, string, bool) {
+	return m.CommonAncestorWithin(ctx, c, headHash, headNum, m.depth)
+}
+
+// CommonAncestorWithin is CommonAncestor walking at most steps blocks back.
+func (m *Manager) CommonAncestorWithin(
+	ctx context.Context,
+	c rpc.Client,
+	headHash string,
+	headNum uint64,
+	maxSteps uint64,
 ) (uint64, string, bool) {
 	// fast path: if we have entry for headNum and hashes equal → ancestor is head itself
 	if h, ok := m.byNum[headNum]; ok && h == headHash {
@@ -73,7 +164,7 @@ func (m *Manager) CommonAncestor(
 	curHash := headHash
 	curNum := headNum
 	steps := uint64(0)
-	for steps <= m.depth && curNum > 0 {
+	for steps <= maxSteps && curNum > 0 {
 		// Do we have a recorded hash for curNum and does it match?
 		if rec, ok := m.byNum[curNum]; ok && rec == curHash {
 			return curNum, curHash, true
@@ -99,13 +190,68 @@ func (m *Manager) RewindRange(ancestor uint64) (uint64, uint64, error) {
 	return ancestor + 1, m.highest, nil
 }
 
-func (m *Manager) ResetAbove(ancestor uint64) {
+// ResetAbove forgets the blocks above ancestor and returns the events published for them.
+func (m *Manager) ResetAbove(ancestor uint64) []kafka.Emitted {
 	for n := range m.byNum {
 		if n > ancestor {
 			delete(m.byNum, n)
 		}
 	}
+	var orphaned []kafka.Emitted
+	for n, evs := range m.events {
+		if n > ancestor {
+			orphaned = append(orphaned, evs...)
+			delete(m.events, n)
+		}
+	}
 	m.highest = ancestor
+	sort.SliceStable(orphaned, func(i, j int) bool { return orphaned[i].BlockNumber < orphaned[j].BlockNumber })
+	return orphaned
+}
+
+// Orphan adds events to Retracting, due once the new chain reaches through.
+func (m *Manager) Orphan(events []kafka.Emitted, through uint64) {
+	if m.Retracting == nil {
+		m.Retracting = &Retraction{}
+	}
+	m.Retracting.Events = append(m.Retracting.Events, events...)
+	m.Retracting.Through = max(m.Retracting.Through, through)
 }
 
 func (m *Manager) Highest() uint64 { return m.highest }
+
+func (m *Manager) Depth() uint64 { return m.depth }
+
+// Hash returns the recorded hash of block n.
+func (m *Manager) Hash(n uint64) (string, bool) {
+	h, ok := m.byNum[n]
+	return h, ok
+}
+
+// Entry is a block of the window with the events published for it.
+type Entry struct {
+	Number uint64          `json:"number"`
+	Hash   string          `json:"hash"`
+	Events []kafka.Emitted `json:"events,omitempty"`
+}
+
+// Window returns the recorded blocks, oldest first, so they can be persisted.
+func (m *Manager) Window() []Entry {
+	out := make([]Entry, 0, len(m.byNum))
+	for n, h := range m.byNum {
+		out = append(out, Entry{Number: n, Hash: h, Events: m.events[n]})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Number < out[j].Number })
+	return out
+}
+
+// Restore replaces the window with entries, e.g. from a checkpoint.
+func (m *Manager) Restore(entries []Entry) {
+	clear(m.byNum)
+	clear(m.events)
+	m.highest = 0
+	for _, e := range entries {
+		m.Record(rpc.Block{Number: e.Number, Hash: e.Hash})
+		m.Remember(rpc.Block{Number: e.Number}, e.Events)
+	}
+}
@@ -2,8 +2,10 @@ package reorg
 
 import (
 	"context"
+	"encoding/json"
 	"testing"
 
+	"github.com/ARK21/deblock/internal/app/kafka"
 	"github.com/ARK21/deblock/internal/app/rpc"
 	"github.com/stretchr/testify/require"
 )
@@ -22,12 +24,21 @@ func (m *mockRPC) GetBlockByHash(_ context.Context, h string, _ bool) (rpc.Block
 func (m *mockRPC) GetBlockByNumber(_ context.Context, n uint64, _ bool) (rpc.Block, error) {
 	return m.byNumber[n], nil
 }
+func (m *mockRPC) GetBlockByTag(context.Context, string, bool) (rpc.Block, error) {
+	return rpc.Block{}, rpc.ErrNotFound
+}
 func (m *mockRPC) GetTxReceipt(context.Context, string) (rpc.Receipt, error) {
 	return rpc.Receipt{}, nil
 }
 func (m *mockRPC) BatchGetReceipts(context.Context, []string) (map[string]rpc.Receipt, error) {
 	return nil, nil
 }
+func (m *mockRPC) GetBlockReceipts(context.Context, string) (map[string]rpc.Receipt, error) {
+	return nil, rpc.ErrBlockReceiptsUnavailable
+}
+func (m *mockRPC) TraceBlock(context.Context, uint64, string) ([]rpc.TraceFrame, error) {
+	return nil, rpc.ErrTracesUnavailable
+}
 func (m *mockRPC) GetChainID(context.Context) (uint64, error)     { return 1, nil }
 func (m *mockRPC) GetBlockNumber(context.Context) (uint64, error) { return 0, nil }
 
@@ -91,3 +102,26 @@ func TestParentOK(t *testing.T) {
 		t.Fatal("should detect mismatch")
 	}
 }
+
+func TestManager_WindowSurvivesRestart(t *testing.T) {
+	m := NewManager(12)
+	m.Record(rpc.Block{Number: 100, Hash: "H100"})
+	m.Record(rpc.Block{Number: 101, Hash: "H101", ParentHash: "H100"})
+	m.Remember(rpc.Block{Number: 101}, []kafka.Emitted{{ID: "e1", FactID: "f1", BlockNumber: 101}})
+
+	// round-trip through the checkpoint's JSON
+	b, err := json.Marshal(m.Window())
+	require.NoError(t, err)
+	var window []Entry
+	require.NoError(t, json.Unmarshal(b, &window))
+
+	restarted := NewManager(12)
+	restarted.Restore(window)
+	require.Equal(t, uint64(101), restarted.Highest())
+	require.False(t, restarted.ParentOK(rpc.Block{Number: 102, ParentHash: "H101p"}))
+	require.True(t, restarted.ParentOK(rpc.Block{Number: 102, ParentHash: "H101"}))
+
+	orphaned := restarted.ResetAbove(100)
+	require.Len(t, orphaned, 1)
+	require.Equal(t, "e1", orphaned[0].ID)
+}
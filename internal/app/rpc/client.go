@@ -1,6 +1,15 @@
 package rpc
 
-import "context"
+import (
+	"context"
+	"errors"
+)
+
+// ErrTracesUnavailable is returned by TraceBlock when tracing is disabled or unsupported by the node.
+var ErrTracesUnavailable = errors.New("traces unavailable")
+
+// ErrBlockReceiptsUnavailable is returned by GetBlockReceipts when the node lacks eth_getBlockReceipts.
+var ErrBlockReceiptsUnavailable = errors.New("block receipts unavailable")
 
 type Header struct {
 	Hash, ParentHash string
@@ -11,10 +20,33 @@ type Client interface {
 	SubscribeNewHeads(ctx context.Context) (<-chan Header, <-chan error)
 	GetBlockByHash(ctx context.Context, hash string, fullTx bool) (Block, error)
 	GetBlockByNumber(ctx context.Context, number uint64, fullTx bool) (Block, error)
+	// GetBlockByTag returns the block of a tag such as "finalized" or "safe".
+	GetBlockByTag(ctx context.Context, tag string, fullTx bool) (Block, error)
 	GetTxReceipt(ctx context.Context, txHash string) (Receipt, error)
 	GetChainID(ctx context.Context) (uint64, error)
 	GetBlockNumber(ctx context.Context) (uint64, error)
 	BatchGetReceipts(ctx context.Context, hashes []string) (map[string]Receipt, error)
+	// GetBlockReceipts returns the receipts of every tx in the block, by tx hash.
+	GetBlockReceipts(ctx context.Context, blockHash string) (map[string]Receipt, error)
+	// TraceBlock returns the call frames of the block number with hash; it fails
+	// rather than return the frames of another block at that height.
+	TraceBlock(ctx context.Context, number uint64, hash string) ([]TraceFrame, error)
+}
+
+// Close releases c's connections, if it holds any.
+func Close(c Client) {
+	if cl, ok := c.(interface{ Close() }); ok {
+		cl.Close()
+	}
+}
+
+// Parallelism returns how many concurrent calls c currently accepts, for
+// callers fanning out single requests.
+func Parallelism(c Client) int {
+	if p, ok := c.(interface{ Parallelism() int }); ok {
+		return p.Parallelism()
+	}
+	return 8
 }
 
 type Tx struct {
@@ -35,4 +67,26 @@ type Receipt struct {
 	Status            uint64
 	GasUsed           string
 	EffectiveGasPrice string
+	Logs              []Log
+}
+
+// Log is an event log emitted by a tx. Topics and Data are 0x-prefixed hex.
+type Log struct {
+	Address string
+	Topics  []string
+	Data    string
+	Index   uint64
+}
+
+// TraceFrame is one frame of a tx call tree, flattened in depth-first order.
+// Path is the frame's position in the tree (trace address); the top-level call has an empty Path.
+type TraceFrame struct {
+	TxHash  string
+	TxIndex int
+	Path    []int
+	Type    string // CALL, DELEGATECALL, CREATE, CREATE2, SELFDESTRUCT, ...
+	From    string
+	To      string
+	Value   string
+	Error   string
 }
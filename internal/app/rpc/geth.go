@@ -2,8 +2,11 @@ package rpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"math/big"
+	"strings"
+	"time"
 
 	"github.com/ARK21/deblock/internal/app/metrics"
 	"github.com/ethereum/go-ethereum/common"
@@ -14,6 +17,12 @@ import (
 type GethClient struct {
 	ws   *rpc.Client
 	http *rpc.Client
+	// TraceMode selects the tracing API used by TraceBlock; TraceOff disables it.
+	TraceMode string
+	// Metrics labels the calls with the chain this client talks to.
+	Metrics *metrics.Chain
+	// Limiter throttles calls to the provider; nil means unlimited.
+	Limiter *Limiter
 }
 
 func NewGethClient(ctx context.Context, wsURL, httpURL string) (*GethClient, error) {
@@ -26,19 +35,70 @@ func NewGethClient(ctx context.Context, wsURL, httpURL string) (*GethClient, err
 	}
 	if httpURL != "" {
 		if http, err = rpc.DialContext(ctx, httpURL); err != nil {
-			return nil, fmt.Errorf("http dial error: %w", err)
+			err = fmt.Errorf("http dial error: %w", err)
 		}
 	}
-	if ws == nil {
-		return nil, fmt.Errorf("ws client is nil")
+	if err == nil && ws == nil {
+		err = fmt.Errorf("ws client is nil")
 	}
-	if http == nil {
-		return nil, fmt.Errorf("http client is nil")
+	if err == nil && http == nil {
+		err = fmt.Errorf("http client is nil")
 	}
+	c := &GethClient{ws: ws, http: http}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the provider connections.
+func (c *GethClient) Close() {
+	if c.ws != nil {
+		c.ws.Close()
+	}
+	if c.http != nil {
+		c.http.Close()
+	}
+}
 
-	return &GethClient{ws: ws, http: http}, nil
+// call is a throttled HTTP call. Rate-limited calls are retried after a
+// jittered backoff, up to Limiter.MaxRetries times.
+func (c *GethClient) call(ctx context.Context, result any, method string, args ...any) error {
+	for attempt := 0; ; attempt++ {
+		if err := c.Limiter.Wait(ctx, method, 1); err != nil {
+			return err
+		}
+		err := c.http.CallContext(ctx, result, method, args...)
+		c.Metrics.RPCCall(method, err == nil)
+		if err == nil {
+			c.Limiter.Success()
+			return nil
+		}
+		if !isRateLimited(err) || c.Limiter == nil || attempt >= c.Limiter.MaxRetries {
+			return err
+		}
+		if c.backoff(ctx, method) != nil {
+			return err
+		}
+	}
 }
 
+// backoff waits out a rate-limit error on method, or returns ctx's error.
+func (c *GethClient) backoff(ctx context.Context, method string) error {
+	t := time.NewTimer(c.Limiter.Throttled(method))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Parallelism is how many calls the provider currently takes at once.
+func (c *GethClient) Parallelism() int { return c.Limiter.Parallelism() }
+
 type rpcHead struct {
 	Hash       common.Hash    `json:"hash"`
 	ParentHash common.Hash    `json:"parentHash"`
@@ -98,46 +158,66 @@ type rpcBlock struct {
 
 func (c *GethClient) GetBlockByHash(ctx context.Context, hash string, fullTx bool) (Block, error) {
 	var rb rpcBlock
-	err := c.http.CallContext(ctx, &rb, "eth_getBlockByHash", hash, fullTx)
-	metrics.RPCCall("eth_getBlockByHash", err == nil)
+	err := c.call(ctx, &rb, "eth_getBlockByHash", hash, fullTx)
 	if err != nil {
 		return Block{}, err
 	}
+	if rb.Hash == (common.Hash{}) {
+		return Block{}, ErrNotFound
+	}
 	return convertBlock(rb), nil
 }
 
 func (c *GethClient) GetBlockByNumber(ctx context.Context, number uint64, fullTx bool) (Block, error) {
 	var rb rpcBlock
-	err := c.http.CallContext(ctx, &rb, "eth_getBlockByNumber", hexutil.Uint64(number), fullTx)
-	metrics.RPCCall("eth_getBlockByNumber", err == nil)
+	err := c.call(ctx, &rb, "eth_getBlockByNumber", hexutil.Uint64(number), fullTx)
 	if err != nil {
 		return Block{}, err
 	}
+	if rb.Hash == (common.Hash{}) {
+		return Block{}, ErrNotFound
+	}
 	return convertBlock(rb), nil
 }
 
+func (c *GethClient) GetBlockByTag(ctx context.Context, tag string, fullTx bool) (Block, error) {
+	var rb rpcBlock
+	err := c.call(ctx, &rb, "eth_getBlockByNumber", tag, fullTx)
+	if err != nil {
+		return Block{}, err
+	}
+	if rb.Hash == (common.Hash{}) {
+		return Block{}, ErrNotFound
+	}
+	return convertBlock(rb), nil
+}
+
+type rpcLog struct {
+	Address common.Address `json:"address"`
+	Topics  []common.Hash  `json:"topics"`
+	Data    hexutil.Bytes  `json:"data"`
+	Index   hexutil.Uint64 `json:"logIndex"`
+}
+
 type rpcReceipt struct {
+	TxHash            common.Hash    `json:"transactionHash"`
+	BlockHash         common.Hash    `json:"blockHash"`
 	Status            hexutil.Uint64 `json:"status"`
 	GasUsed           hexutil.Uint64 `json:"gasUsed"`
 	EffectiveGasPrice *hexutil.Big   `json:"effectiveGasPrice"`
+	Logs              []rpcLog       `json:"logs"`
 }
 
 func (c *GethClient) GetTxReceipt(ctx context.Context, txHash string) (Receipt, error) {
 	var rr rpcReceipt
-	err := c.http.CallContext(ctx, &rr, "eth_getTransactionReceipt", txHash)
-	metrics.RPCCall("eth_getTransactionReceipt", err == nil)
+	err := c.call(ctx, &rr, "eth_getTransactionReceipt", txHash)
 	if err != nil {
 		return Receipt{}, err
 	}
-	egp := big.NewInt(0)
-	if rr.EffectiveGasPrice != nil {
-		egp = (*big.Int)(rr.EffectiveGasPrice)
+	if rr.BlockHash == (common.Hash{}) {
+		return Receipt{}, fmt.Errorf("receipt %s: %w", txHash, ErrNotFound)
 	}
-	return Receipt{
-		Status:            uint64(rr.Status),
-		GasUsed:           fmt.Sprintf("%d", uint64(rr.GasUsed)),
-		EffectiveGasPrice: egp.String(),
-	}, nil
+	return convertReceipt(rr), nil
 }
 
 func (c *GethClient) BatchGetReceipts(ctx context.Context, hashes []string) (map[string]Receipt, error) {
@@ -146,13 +226,10 @@ func (c *GethClient) BatchGetReceipts(ctx context.Context, hashes []string) (map
 		return out, nil
 	}
 
-	const chunk = 50 // safe default for most providers
-
-	for i := 0; i < len(hashes); i += chunk {
-		j := i + chunk
-		if j > len(hashes) {
-			j = len(hashes)
-		}
+	retries := 0
+	for i := 0; i < len(hashes); {
+		// the limiter shrinks the batch while the provider throttles us
+		j := min(i+c.Limiter.BatchSize(), len(hashes))
 		h := hashes[i:j]
 		rr := make([]rpcReceipt, len(h))
 		batch := make([]rpc.BatchElem, len(h))
@@ -163,33 +240,77 @@ func (c *GethClient) BatchGetReceipts(ctx context.Context, hashes []string) (map
 				Result: &rr[k],
 			}
 		}
-		metrics.ObserveReceiptBatch(len(h))
-		metrics.ReceiptsInFlight(len(h))
+		if err := c.Limiter.Wait(ctx, "eth_getTransactionReceipt", len(h)); err != nil {
+			return nil, err
+		}
+		c.Metrics.ObserveReceiptBatch(len(h))
+		c.Metrics.ReceiptsInFlight(len(h))
 		err := c.http.BatchCallContext(ctx, batch)
-		metrics.ReceiptsInFlight(0)
-		metrics.RPCCall("eth_getTransactionReceipt_batch", err == nil)
+		c.Metrics.ReceiptsInFlight(0)
+		if err == nil {
+			// some providers throttle single elements of an otherwise fine batch
+			for _, b := range batch {
+				if b.Error != nil && isRateLimited(b.Error) {
+					err = b.Error
+					break
+				}
+			}
+		}
+		c.Metrics.RPCCall("eth_getTransactionReceipt_batch", err == nil)
+		if err != nil && isRateLimited(err) && c.Limiter != nil && retries < c.Limiter.MaxRetries {
+			retries++
+			if c.backoff(ctx, "eth_getTransactionReceipt_batch") == nil {
+				continue // same offset, smaller batch
+			}
+		}
 		if err != nil {
 			return nil, fmt.Errorf("batch call error: %w", err)
 		}
+		c.Limiter.Success()
+		retries = 0
 		for k, r := range rr {
-			egp := big.NewInt(0)
-			if r.EffectiveGasPrice != nil {
-				egp = (*big.Int)(r.EffectiveGasPrice)
+			if batch[k].Error != nil {
+				return nil, fmt.Errorf("receipt %s: %w", h[k], batch[k].Error)
 			}
-			out[hashes[k]] = Receipt{
-				Status:            uint64(r.Status),
-				GasUsed:           fmt.Sprintf("%d", uint64(r.GasUsed)),
-				EffectiveGasPrice: egp.String(),
+			if r.BlockHash == (common.Hash{}) {
+				return nil, fmt.Errorf("receipt %s: %w", h[k], ErrNotFound)
 			}
+			out[h[k]] = convertReceipt(r)
 		}
+		i = j
 	}
 
 	return out, nil
 }
 
+// GetBlockReceipts fetches every receipt of the block in one eth_getBlockReceipts call.
+func (c *GethClient) GetBlockReceipts(ctx context.Context, blockHash string) (map[string]Receipt, error) {
+	var rr []rpcReceipt
+	err := c.call(ctx, &rr, "eth_getBlockReceipts", blockHash)
+	if err != nil {
+		var rpcErr rpc.Error
+		if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == -32601 {
+			return nil, fmt.Errorf("%w: %v", ErrBlockReceiptsUnavailable, err)
+		}
+		return nil, err
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("block %s: %w", blockHash, ErrNotFound)
+	}
+	out := make(map[string]Receipt, len(rr))
+	for _, r := range rr {
+		if r.BlockHash != common.HexToHash(blockHash) {
+			// never mix receipts of different blocks
+			return nil, fmt.Errorf("block %s: receipt %s from block %s", blockHash, r.TxHash.Hex(), r.BlockHash.Hex())
+		}
+		out[r.TxHash.Hex()] = convertReceipt(r)
+	}
+	return out, nil
+}
+
 func (c *GethClient) GetChainID(ctx context.Context) (uint64, error) {
 	var hex hexutil.Big
-	if err := c.http.CallContext(ctx, &hex, "eth_chainId"); err != nil {
+	if err := c.call(ctx, &hex, "eth_chainId"); err != nil {
 		return 0, err
 	}
 
@@ -198,8 +319,7 @@ func (c *GethClient) GetChainID(ctx context.Context) (uint64, error) {
 
 func (c *GethClient) GetBlockNumber(ctx context.Context) (uint64, error) {
 	var num hexutil.Uint64
-	err := c.http.CallContext(ctx, &num, "eth_blockNumber")
-	metrics.RPCCall("eth_blockNumber", err == nil)
+	err := c.call(ctx, &num, "eth_blockNumber")
 	if err != nil {
 		return 0, err
 	}
@@ -212,7 +332,7 @@ func convertBlock(rb rpcBlock) Block {
 		Number:     uint64(rb.Number),
 		ParentHash: rb.ParentHash.Hex(),
 		Timestamp:  uint64(rb.Timestamp),
-		Txs:        make([]Tx, len(rb.Txs)),
+		Txs:        make([]Tx, 0, len(rb.Txs)),
 	}
 	for _, t := range rb.Txs {
 		var to *string
@@ -234,3 +354,189 @@ func convertBlock(rb rpcBlock) Block {
 
 	return b
 }
+
+func convertReceipt(rr rpcReceipt) Receipt {
+	egp := big.NewInt(0)
+	if rr.EffectiveGasPrice != nil {
+		egp = (*big.Int)(rr.EffectiveGasPrice)
+	}
+	r := Receipt{
+		Status:            uint64(rr.Status),
+		GasUsed:           fmt.Sprintf("%d", uint64(rr.GasUsed)),
+		EffectiveGasPrice: egp.String(),
+		Logs:              make([]Log, 0, len(rr.Logs)),
+	}
+	for _, l := range rr.Logs {
+		topics := make([]string, len(l.Topics))
+		for i, t := range l.Topics {
+			topics[i] = t.Hex()
+		}
+		r.Logs = append(r.Logs, Log{
+			Address: l.Address.Hex(),
+			Topics:  topics,
+			Data:    hexutil.Encode(l.Data),
+			Index:   uint64(l.Index),
+		})
+	}
+	return r
+}
+
+// Trace modes for GethClient.TraceMode.
+const (
+	TraceOff    = ""
+	TraceDebug  = "debug"  // debug_traceBlockByHash with callTracer (geth, erigon, reth)
+	TraceParity = "parity" // trace_block (erigon, nethermind)
+)
+
+type rpcCallFrame struct {
+	Type  string          `json:"type"`
+	From  common.Address  `json:"from"`
+	To    *common.Address `json:"to"`
+	Value *hexutil.Big    `json:"value"`
+	Error string          `json:"error"`
+	Calls []rpcCallFrame  `json:"calls"`
+}
+
+type rpcTxTrace struct {
+	TxHash common.Hash  `json:"txHash"`
+	Result rpcCallFrame `json:"result"`
+}
+
+type rpcParityTrace struct {
+	Action struct {
+		CallType      string          `json:"callType"`
+		From          common.Address  `json:"from"`
+		To            *common.Address `json:"to"`
+		Value         *hexutil.Big    `json:"value"`
+		Address       common.Address  `json:"address"`
+		RefundAddress *common.Address `json:"refundAddress"`
+		Balance       *hexutil.Big    `json:"balance"`
+	} `json:"action"`
+	Result *struct {
+		Address *common.Address `json:"address"`
+	} `json:"result"`
+	Error               string       `json:"error"`
+	BlockHash           common.Hash  `json:"blockHash"`
+	TraceAddress        []int        `json:"traceAddress"`
+	TransactionHash     *common.Hash `json:"transactionHash"`
+	TransactionPosition *int         `json:"transactionPosition"`
+	Type                string       `json:"type"`
+}
+
+// traceErr marks errors of nodes without the tracing API as ErrTracesUnavailable.
+func traceErr(err error) error {
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == -32601 {
+		return fmt.Errorf("%w: %v", ErrTracesUnavailable, err)
+	}
+	return err
+}
+
+// TraceBlock returns the flattened call trees of every tx in the block, using TraceMode.
+// trace_block only takes a number, so its traces are checked against hash.
+func (c *GethClient) TraceBlock(ctx context.Context, number uint64, hash string) ([]TraceFrame, error) {
+	switch c.TraceMode {
+	case TraceDebug:
+		var txs []rpcTxTrace
+		err := c.call(ctx, &txs, "debug_traceBlockByHash", common.HexToHash(hash), map[string]any{"tracer": "callTracer"})
+		if err != nil {
+			return nil, traceErr(err)
+		}
+		var out []TraceFrame
+		for i, tx := range txs {
+			hash := ""
+			if tx.TxHash != (common.Hash{}) {
+				hash = tx.TxHash.Hex()
+			}
+			out = flattenCallFrame(out, tx.Result, hash, i, nil)
+		}
+		return out, nil
+	case TraceParity:
+		var traces []rpcParityTrace
+		err := c.call(ctx, &traces, "trace_block", hexutil.Uint64(number))
+		if err != nil {
+			return nil, traceErr(err)
+		}
+		out := make([]TraceFrame, 0, len(traces))
+		for _, t := range traces {
+			if !strings.EqualFold(t.BlockHash.Hex(), hash) {
+				return nil, fmt.Errorf("trace_block %d returned block %s, want %s", number, t.BlockHash.Hex(), hash)
+			}
+			if f, ok := convertParityTrace(t); ok {
+				out = append(out, f)
+			}
+		}
+		return out, nil
+	default:
+		return nil, ErrTracesUnavailable
+	}
+}
+
+func flattenCallFrame(out []TraceFrame, cf rpcCallFrame, txHash string, txIndex int, path []int) []TraceFrame {
+	to := ""
+	if cf.To != nil {
+		to = cf.To.Hex()
+	}
+	val := big.NewInt(0)
+	if cf.Value != nil {
+		val = (*big.Int)(cf.Value)
+	}
+	out = append(out, TraceFrame{
+		TxHash:  txHash,
+		TxIndex: txIndex,
+		Path:    path,
+		Type:    strings.ToUpper(cf.Type),
+		From:    cf.From.Hex(),
+		To:      to,
+		Value:   val.String(),
+		Error:   cf.Error,
+	})
+	for i, sub := range cf.Calls {
+		p := append(append(make([]int, 0, len(path)+1), path...), i)
+		out = flattenCallFrame(out, sub, txHash, txIndex, p)
+	}
+	return out
+}
+
+func convertParityTrace(t rpcParityTrace) (TraceFrame, bool) {
+	if t.TransactionPosition == nil {
+		return TraceFrame{}, false // block and uncle rewards
+	}
+	f := TraceFrame{
+		TxIndex: *t.TransactionPosition,
+		Path:    t.TraceAddress,
+		Error:   t.Error,
+	}
+	if t.TransactionHash != nil {
+		f.TxHash = t.TransactionHash.Hex()
+	}
+	val := t.Action.Value
+	switch t.Type {
+	case "call":
+		f.Type = strings.ToUpper(t.Action.CallType)
+		f.From = t.Action.From.Hex()
+		if t.Action.To != nil {
+			f.To = t.Action.To.Hex()
+		}
+	case "create":
+		f.Type = "CREATE"
+		f.From = t.Action.From.Hex()
+		if t.Result != nil && t.Result.Address != nil {
+			f.To = t.Result.Address.Hex()
+		}
+	case "suicide":
+		f.Type = "SELFDESTRUCT"
+		f.From = t.Action.Address.Hex()
+		if t.Action.RefundAddress != nil {
+			f.To = t.Action.RefundAddress.Hex()
+		}
+		val = t.Action.Balance
+	default:
+		return TraceFrame{}, false
+	}
+	f.Value = "0"
+	if val != nil {
+		f.Value = (*big.Int)(val).String()
+	}
+	return f, true
+}
@@ -0,0 +1,87 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+// blockPayload is eth_getBlockByNumber for a block with a transfer and a contract creation.
+const blockPayload = `{
+	"hash": "0x6d6c1a2b4bbf3b2b0d6d2f6b4d0e7c4e8b1f1e6b2e3d4c5b6a7988776655443a",
+	"number": "0x12a05f2",
+	"parentHash": "0x1f1e1d1c1b1a19181716151413121110f0e0d0c0b0a090807060504030201000",
+	"timestamp": "0x66000000",
+	"transactions": [
+		{
+			"hash": "0xaa00000000000000000000000000000000000000000000000000000000000001",
+			"from": "0x1111111111111111111111111111111111111111",
+			"to": "0x2222222222222222222222222222222222222222",
+			"value": "0xde0b6b3a7640000"
+		},
+		{
+			"hash": "0xaa00000000000000000000000000000000000000000000000000000000000002",
+			"from": "0x3333333333333333333333333333333333333333",
+			"to": null,
+			"value": "0x0"
+		}
+	]
+}`
+
+// rpcServer answers every JSON-RPC call with result.
+func rpcServer(t *testing.T, result string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ID json.RawMessage `json:"id"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":` + string(req.ID) + `,"result":` + result + `}`))
+	}))
+}
+
+func TestGethClient_DecodesBlock(t *testing.T) {
+	srv := rpcServer(t, blockPayload)
+	defer srv.Close()
+	http, err := rpc.DialHTTP(srv.URL)
+	require.NoError(t, err)
+	c := &GethClient{http: http}
+
+	blk, err := c.GetBlockByNumber(context.Background(), 19531250, true)
+	require.NoError(t, err)
+
+	require.Equal(t, uint64(19531250), blk.Number)
+	require.Len(t, blk.Txs, 2)
+	require.Equal(t, "0xaa00000000000000000000000000000000000000000000000000000000000001", blk.Txs[0].Hash)
+	require.Equal(t, "0x2222222222222222222222222222222222222222", *blk.Txs[0].To)
+	require.Equal(t, "1000000000000000000", blk.Txs[0].Value)
+	require.Nil(t, blk.Txs[1].To)
+	require.Equal(t, "0", blk.Txs[1].Value)
+}
+
+func TestGethClient_ParityTraceOfOtherBlock(t *testing.T) {
+	srv := rpcServer(t, `[{
+		"action": {"callType": "call", "from": "0x1111111111111111111111111111111111111111", "to": "0x2222222222222222222222222222222222222222", "value": "0x1"},
+		"blockHash": "0x00000000000000000000000000000000000000000000000000000000000000bb",
+		"traceAddress": [],
+		"transactionPosition": 0,
+		"type": "call"
+	}]`)
+	defer srv.Close()
+	http, err := rpc.DialHTTP(srv.URL)
+	require.NoError(t, err)
+	c := &GethClient{http: http, TraceMode: TraceParity}
+
+	// the node moved to another block at that height since we fetched ours
+	_, err = c.TraceBlock(context.Background(), 7, "0x00000000000000000000000000000000000000000000000000000000000000aa")
+	require.ErrorContains(t, err, "want 0x00000000000000000000000000000000000000000000000000000000000000aa")
+
+	frames, err := c.TraceBlock(context.Background(), 7, "0x00000000000000000000000000000000000000000000000000000000000000bb")
+	require.NoError(t, err)
+	require.Len(t, frames, 1)
+}
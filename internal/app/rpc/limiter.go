@@ -0,0 +1,227 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ARK21/deblock/internal/app/metrics"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Limiter throttles the calls of one provider. Each method draws from its own
+// token bucket (a batch draws one token per element), and batch size and
+// parallelism follow AIMD: they grow by one after a run of successes and halve
+// when the provider answers with a rate-limit error.
+type Limiter struct {
+	// MaxRetries is how often a rate-limited call is retried after backing off.
+	MaxRetries int
+	// BackoffFloor and BackoffCeil bound the jittered backoff after a rate-limit error.
+	BackoffFloor time.Duration
+	BackoffCeil  time.Duration
+	Metrics      *metrics.Chain
+
+	mu       sync.Mutex
+	budgets  map[string]*bucket
+	fallback *bucket // for methods without their own budget; nil means unlimited
+	batch    aimd
+	parallel aimd
+	failures int // consecutive rate-limit errors, drives the backoff
+}
+
+// Budget is the sustained rate of one method in requests per second.
+type Budget struct {
+	Method string
+	Rate   float64
+}
+
+// NewLimiter builds a Limiter from per-method budgets. The method "*" is the
+// budget of every method not listed; without it unlisted methods are unlimited.
+func NewLimiter(budgets []Budget) *Limiter {
+	l := &Limiter{
+		MaxRetries:   3,
+		BackoffFloor: 250 * time.Millisecond,
+		BackoffCeil:  10 * time.Second,
+		budgets:      make(map[string]*bucket),
+		batch:        aimd{cur: 50, min: 1, max: 200},
+		parallel:     aimd{cur: 8, min: 1, max: 32},
+	}
+	for _, b := range budgets {
+		if b.Rate <= 0 {
+			continue
+		}
+		bk := newBucket(b.Rate)
+		if b.Method == "*" {
+			l.fallback = bk
+		} else {
+			l.budgets[b.Method] = bk
+		}
+	}
+	return l
+}
+
+// Wait blocks until n requests of method fit in its budget. A nil Limiter never waits.
+func (l *Limiter) Wait(ctx context.Context, method string, n int) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	bk, ok := l.budgets[method]
+	if !ok {
+		bk = l.fallback
+	}
+	l.mu.Unlock()
+	if bk == nil {
+		return nil
+	}
+	return bk.wait(ctx, n)
+}
+
+// BatchSize is the current number of elements per batch call.
+func (l *Limiter) BatchSize() int {
+	if l == nil {
+		return 50
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.batch.cur
+}
+
+// Parallelism is the current number of concurrent calls to the provider.
+func (l *Limiter) Parallelism() int {
+	if l == nil {
+		return 8
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.parallel.cur
+}
+
+// Success records a call that wasn't throttled.
+func (l *Limiter) Success() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.failures = 0
+	grewBatch := l.batch.success()
+	grewParallel := l.parallel.success()
+	batch, parallel := l.batch.cur, l.parallel.cur
+	l.mu.Unlock()
+	if grewBatch || grewParallel {
+		l.report(batch, parallel)
+	}
+}
+
+// Throttled records a rate-limit error on method, shrinks the limits and
+// returns how long to back off before the next attempt.
+func (l *Limiter) Throttled(method string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	l.batch.throttled()
+	l.parallel.throttled()
+	l.failures++
+	backoff := l.BackoffFloor << min(l.failures-1, 16)
+	if backoff > l.BackoffCeil || backoff <= 0 {
+		backoff = l.BackoffCeil
+	}
+	backoff = max(backoff, time.Millisecond)
+	batch, parallel := l.batch.cur, l.parallel.cur
+	l.mu.Unlock()
+
+	l.Metrics.RPCThrottled(method)
+	l.report(batch, parallel)
+	// full jitter, so throttled callers don't retry in lockstep
+	return time.Duration(rand.Int63n(int64(backoff)) + 1)
+}
+
+func (l *Limiter) report(batch, parallel int) {
+	l.Metrics.SetRPCLimit("batch_size", batch)
+	l.Metrics.SetRPCLimit("parallelism", parallel)
+}
+
+// aimd is an additive-increase/multiplicative-decrease limit. It grows after
+// window successes in a row, so one lucky call doesn't undo a throttle.
+type aimd struct {
+	cur, min, max int
+	streak        int
+}
+
+const aimdWindow = 20
+
+func (a *aimd) success() bool {
+	a.streak++
+	if a.streak < aimdWindow || a.cur >= a.max {
+		return false
+	}
+	a.streak = 0
+	a.cur++
+	return true
+}
+
+func (a *aimd) throttled() {
+	a.streak = 0
+	a.cur = max(a.min, a.cur/2)
+}
+
+// bucket is a token bucket refilled at rate tokens per second, holding up to
+// one second worth of tokens.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64) *bucket {
+	burst := max(rate, 1)
+	return &bucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *bucket) wait(ctx context.Context, n int) error {
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+		// a request larger than the bucket goes through once the bucket is full
+		need := min(float64(n), b.burst)
+		if b.tokens >= need {
+			b.tokens -= need
+			b.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+		b.mu.Unlock()
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// isRateLimited reports whether err is a provider throttling us (HTTP 429 or
+// the JSON-RPC "limit exceeded" error most providers use instead).
+func isRateLimited(err error) bool {
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusTooManyRequests {
+		return true
+	}
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) && rpcErr.ErrorCode() == -32005 {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "too many requests") || strings.Contains(msg, "rate limit")
+}
@@ -0,0 +1,70 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiter_AIMD(t *testing.T) {
+	l := NewLimiter(nil)
+	l.BackoffFloor, l.BackoffCeil = time.Millisecond, 10*time.Millisecond
+	require.Equal(t, 50, l.BatchSize())
+	require.Equal(t, 8, l.Parallelism())
+
+	d := l.Throttled("eth_getTransactionReceipt")
+	require.Positive(t, d)
+	require.LessOrEqual(t, d, time.Millisecond)
+	require.Equal(t, 25, l.BatchSize())
+	require.Equal(t, 4, l.Parallelism())
+
+	for i := 0; i < 10; i++ {
+		l.Throttled("eth_getTransactionReceipt")
+	}
+	require.Equal(t, 1, l.BatchSize())
+	require.Equal(t, 1, l.Parallelism())
+
+	// additive increase: one step per window of successes
+	for i := 0; i < aimdWindow; i++ {
+		l.Success()
+	}
+	require.Equal(t, 2, l.BatchSize())
+	require.Equal(t, 2, l.Parallelism())
+}
+
+func TestLimiter_Budget(t *testing.T) {
+	l := NewLimiter([]Budget{{Method: "eth_blockNumber", Rate: 100}})
+	ctx := context.Background()
+
+	start := time.Now()
+	for i := 0; i < 120; i++ {
+		require.NoError(t, l.Wait(ctx, "eth_blockNumber", 1))
+	}
+	// 100 burst tokens, the other 20 at 100/s
+	require.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+
+	// no "*" budget: other methods are unlimited
+	start = time.Now()
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, l.Wait(ctx, "eth_getBlockByNumber", 1))
+	}
+	require.Less(t, time.Since(start), 50*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	require.ErrorIs(t, l.Wait(ctx, "eth_blockNumber", 100), context.Canceled)
+}
+
+func TestIsRateLimited(t *testing.T) {
+	require.True(t, isRateLimited(rpc.HTTPError{StatusCode: http.StatusTooManyRequests}))
+	require.True(t, isRateLimited(fmt.Errorf("batch call error: %w", rpc.HTTPError{StatusCode: http.StatusTooManyRequests})))
+	require.True(t, isRateLimited(errors.New("project ID request rate exceeded: rate limit")))
+	require.False(t, isRateLimited(rpc.HTTPError{StatusCode: http.StatusBadGateway}))
+	require.False(t, isRateLimited(errors.New("header not found")))
+}
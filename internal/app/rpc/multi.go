@@ -0,0 +1,318 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ARK21/deblock/internal/app/metrics"
+)
+
+// Provider is one named endpoint behind a MultiClient.
+type Provider struct {
+	Name   string
+	Client Client
+}
+
+// MultiClient is a Client over several providers of the same chain. Every call
+// goes to the healthiest provider and fails over to the next one on error.
+//
+// Health is an EWMA of latency and error rate. Providers that answer 429 or fall
+// more than MaxLag blocks behind the best known head are quarantined for a while.
+type MultiClient struct {
+	providers []*provider
+	// MaxLag is how far a provider's head may trail the best head before quarantine.
+	MaxLag uint64
+	// Quarantine is how long a rate-limited or lagging provider is skipped.
+	Quarantine time.Duration
+	Metrics    *metrics.Chain
+}
+
+type provider struct {
+	name   string
+	client Client
+
+	mu      sync.Mutex
+	latency time.Duration // EWMA
+	errRate float64       // EWMA of failed calls, 0..1
+	head    uint64
+	until   time.Time // quarantined until
+}
+
+const ewmaWeight = 0.2
+
+func NewMultiClient(providers []Provider) *MultiClient {
+	m := &MultiClient{MaxLag: 3, Quarantine: 30 * time.Second}
+	for _, p := range providers {
+		m.providers = append(m.providers, &provider{name: p.Name, client: p.Client})
+	}
+	return m
+}
+
+func (p *provider) observe(d time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.latency == 0 {
+		p.latency = d
+	} else {
+		p.latency = time.Duration((1-ewmaWeight)*float64(p.latency) + ewmaWeight*float64(d))
+	}
+	failed := 0.0
+	if err != nil {
+		failed = 1
+	}
+	p.errRate = (1-ewmaWeight)*p.errRate + ewmaWeight*failed
+}
+
+// score is lower for healthier providers; errors weigh far more than latency.
+func (p *provider) score() float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return float64(p.latency.Milliseconds()+1) * (1 + 20*p.errRate)
+}
+
+func (p *provider) quarantined(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return now.Before(p.until)
+}
+
+func (p *provider) headAt() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.head
+}
+
+// ordered returns the providers to try, best first. Quarantined ones go last
+// rather than being dropped, so a call still has somewhere to go when all are.
+// With minHead > 0, providers that haven't reached that block are tried late too.
+func (m *MultiClient) ordered(minHead uint64) []*provider {
+	now := time.Now()
+	type cand struct {
+		p      *provider
+		demote bool
+		score  float64
+	}
+	cs := make([]cand, len(m.providers))
+	for i, p := range m.providers {
+		behind := minHead > 0 && p.headAt() > 0 && p.headAt() < minHead
+		cs[i] = cand{p: p, demote: p.quarantined(now) || behind, score: p.score()}
+	}
+	sort.SliceStable(cs, func(i, j int) bool {
+		if cs[i].demote != cs[j].demote {
+			return !cs[i].demote
+		}
+		return cs[i].score < cs[j].score
+	})
+	out := make([]*provider, len(cs))
+	for i, c := range cs {
+		out[i] = c.p
+	}
+	return out
+}
+
+func (m *MultiClient) quarantine(p *provider, reason string) {
+	p.mu.Lock()
+	already := time.Now().Before(p.until)
+	p.until = time.Now().Add(m.Quarantine)
+	head := p.head
+	p.mu.Unlock()
+	m.Metrics.SetProviderHealth(p.name, false, head)
+	if !already {
+		log.Printf("[rpc] quarantine provider %s for %s: %s", p.name, m.Quarantine, reason)
+	}
+}
+
+// setHead records a provider's head and quarantines providers trailing the best one.
+func (m *MultiClient) setHead(p *provider, n uint64) {
+	p.mu.Lock()
+	if n > p.head {
+		p.head = n
+	}
+	p.mu.Unlock()
+
+	var best uint64
+	for _, q := range m.providers {
+		best = max(best, q.headAt())
+	}
+	now := time.Now()
+	for _, q := range m.providers {
+		h := q.headAt()
+		if h > 0 && best-h > m.MaxLag {
+			m.quarantine(q, fmt.Sprintf("head %d is %d blocks behind", h, best-h))
+		} else {
+			m.Metrics.SetProviderHealth(q.name, !q.quarantined(now), h)
+		}
+	}
+}
+
+// call runs fn against the providers in order until one succeeds.
+func call[T any](ctx context.Context, m *MultiClient, minHead uint64, fn func(*provider) (T, error)) (T, error) {
+	var zero T
+	var lastErr error
+	ps := m.ordered(minHead)
+	for i, p := range ps {
+		start := time.Now()
+		v, err := fn(p)
+		if ctx.Err() != nil {
+			// our own cancellation says nothing about the provider
+			return v, err
+		}
+		if err == nil {
+			p.observe(time.Since(start), nil)
+			return v, nil
+		}
+		lastErr = err
+		if errors.Is(err, ErrTracesUnavailable) || errors.Is(err, ErrBlockReceiptsUnavailable) {
+			// a capability of the node, not a fault: try the others without penalty
+			continue
+		}
+		p.observe(time.Since(start), err)
+		if isRateLimited(err) {
+			m.quarantine(p, "rate limited")
+		}
+		if i < len(ps)-1 {
+			m.Metrics.RPCFailover(p.name)
+			log.Printf("[rpc] provider %s failed, failing over: %v", p.name, err)
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no rpc providers")
+	}
+	if !errors.Is(lastErr, ErrTracesUnavailable) && !errors.Is(lastErr, ErrBlockReceiptsUnavailable) {
+		m.Metrics.RPCUnavailable()
+	}
+	return zero, lastErr
+}
+
+// Run probes every provider's head each interval so lagging providers are found
+// even when no call goes to them, and quarantined ones can recover.
+func (m *MultiClient) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		for _, p := range m.providers {
+			start := time.Now()
+			n, err := p.client.GetBlockNumber(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			p.observe(time.Since(start), err)
+			if err != nil {
+				if isRateLimited(err) {
+					m.quarantine(p, "rate limited")
+				}
+				continue
+			}
+			m.setHead(p, n)
+		}
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// SubscribeNewHeads subscribes on the best provider. heads.Source resubscribes on
+// error, which then picks whichever provider is best at that time.
+func (m *MultiClient) SubscribeNewHeads(ctx context.Context) (<-chan Header, <-chan error) {
+	p := m.ordered(0)[0]
+	in, inErrs := p.client.SubscribeNewHeads(ctx)
+	out := make(chan Header, 64)
+	errs := make(chan error, 1)
+	go func() {
+		defer close(out)
+		defer close(errs)
+		for in != nil {
+			select {
+			case h, ok := <-in:
+				if !ok {
+					in = nil
+					continue
+				}
+				m.setHead(p, h.Number)
+				out <- h
+			case err, ok := <-inErrs:
+				if !ok {
+					inErrs = nil
+					continue
+				}
+				p.observe(0, err)
+				errs <- fmt.Errorf("%s: %w", p.name, err)
+				return
+			}
+		}
+	}()
+	return out, errs
+}
+
+func (m *MultiClient) GetBlockByHash(ctx context.Context, hash string, fullTx bool) (Block, error) {
+	return call(ctx, m, 0, func(p *provider) (Block, error) { return p.client.GetBlockByHash(ctx, hash, fullTx) })
+}
+
+func (m *MultiClient) GetBlockByTag(ctx context.Context, tag string, fullTx bool) (Block, error) {
+	return call(ctx, m, 0, func(p *provider) (Block, error) { return p.client.GetBlockByTag(ctx, tag, fullTx) })
+}
+
+func (m *MultiClient) GetBlockByNumber(ctx context.Context, number uint64, fullTx bool) (Block, error) {
+	return call(ctx, m, number, func(p *provider) (Block, error) { return p.client.GetBlockByNumber(ctx, number, fullTx) })
+}
+
+func (m *MultiClient) GetTxReceipt(ctx context.Context, txHash string) (Receipt, error) {
+	return call(ctx, m, 0, func(p *provider) (Receipt, error) { return p.client.GetTxReceipt(ctx, txHash) })
+}
+
+// GetChainID asks every provider and fails if they disagree, which means a
+// provider was configured for the wrong chain.
+func (m *MultiClient) GetChainID(ctx context.Context) (uint64, error) {
+	var id uint64
+	var from string
+	for _, p := range m.providers {
+		got, err := p.client.GetChainID(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", p.name, err)
+		}
+		if from != "" && got != id {
+			return 0, fmt.Errorf("providers disagree on chain id: %s=%d, %s=%d", from, id, p.name, got)
+		}
+		id, from = got, p.name
+	}
+	return id, nil
+}
+
+func (m *MultiClient) GetBlockNumber(ctx context.Context) (uint64, error) {
+	return call(ctx, m, 0, func(p *provider) (uint64, error) {
+		n, err := p.client.GetBlockNumber(ctx)
+		if err == nil {
+			m.setHead(p, n)
+		}
+		return n, err
+	})
+}
+
+func (m *MultiClient) BatchGetReceipts(ctx context.Context, hashes []string) (map[string]Receipt, error) {
+	return call(ctx, m, 0, func(p *provider) (map[string]Receipt, error) { return p.client.BatchGetReceipts(ctx, hashes) })
+}
+
+func (m *MultiClient) GetBlockReceipts(ctx context.Context, blockHash string) (map[string]Receipt, error) {
+	return call(ctx, m, 0, func(p *provider) (map[string]Receipt, error) { return p.client.GetBlockReceipts(ctx, blockHash) })
+}
+
+func (m *MultiClient) TraceBlock(ctx context.Context, number uint64, hash string) ([]TraceFrame, error) {
+	return call(ctx, m, number, func(p *provider) ([]TraceFrame, error) { return p.client.TraceBlock(ctx, number, hash) })
+}
+
+// Close closes every provider.
+func (m *MultiClient) Close() {
+	for _, p := range m.providers {
+		Close(p.client)
+	}
+}
+
+// Parallelism is the parallelism of the provider calls currently go to.
+func (m *MultiClient) Parallelism() int { return Parallelism(m.ordered(0)[0].client) }
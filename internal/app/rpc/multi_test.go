@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+// stubClient answers from fixed values and counts calls.
+type stubClient struct {
+	head  uint64
+	err   error
+	calls int
+}
+
+func (s *stubClient) SubscribeNewHeads(context.Context) (<-chan Header, <-chan error) {
+	return nil, make(chan error)
+}
+func (s *stubClient) GetBlockByHash(context.Context, string, bool) (Block, error) {
+	s.calls++
+	return Block{}, s.err
+}
+func (s *stubClient) GetBlockByNumber(_ context.Context, n uint64, _ bool) (Block, error) {
+	s.calls++
+	return Block{Number: n}, s.err
+}
+func (s *stubClient) GetBlockByTag(context.Context, string, bool) (Block, error) {
+	return Block{}, s.err
+}
+func (s *stubClient) GetTxReceipt(context.Context, string) (Receipt, error) {
+	s.calls++
+	return Receipt{}, s.err
+}
+func (s *stubClient) BatchGetReceipts(context.Context, []string) (map[string]Receipt, error) {
+	s.calls++
+	return nil, s.err
+}
+func (s *stubClient) GetBlockReceipts(context.Context, string) (map[string]Receipt, error) {
+	return nil, ErrBlockReceiptsUnavailable
+}
+func (s *stubClient) TraceBlock(context.Context, uint64, string) ([]TraceFrame, error) {
+	return nil, ErrTracesUnavailable
+}
+func (s *stubClient) GetChainID(context.Context) (uint64, error) { return 1, nil }
+func (s *stubClient) GetBlockNumber(context.Context) (uint64, error) {
+	s.calls++
+	return s.head, s.err
+}
+
+func TestMultiClient_FailsOverOnError(t *testing.T) {
+	bad := &stubClient{head: 100, err: errors.New("boom")}
+	good := &stubClient{head: 100}
+	m := NewMultiClient([]Provider{{Name: "bad", Client: bad}, {Name: "good", Client: good}})
+
+	blk, err := m.GetBlockByNumber(context.Background(), 90, true)
+	require.NoError(t, err)
+	require.Equal(t, uint64(90), blk.Number)
+	require.Equal(t, 1, bad.calls)
+	require.Equal(t, 1, good.calls)
+
+	// the failing provider now scores worse and is no longer tried first
+	_, err = m.GetBlockByNumber(context.Background(), 91, true)
+	require.NoError(t, err)
+	require.Equal(t, 1, bad.calls)
+	require.Equal(t, 2, good.calls)
+}
+
+func TestMultiClient_QuarantinesRateLimited(t *testing.T) {
+	limited := &stubClient{head: 100, err: rpc.HTTPError{StatusCode: http.StatusTooManyRequests, Status: "429 Too Many Requests"}}
+	other := &stubClient{head: 100}
+	m := NewMultiClient([]Provider{{Name: "limited", Client: limited}, {Name: "other", Client: other}})
+
+	_, err := m.GetTxReceipt(context.Background(), "0x1")
+	require.NoError(t, err)
+	require.True(t, m.providers[0].quarantined(time.Now()))
+	require.Equal(t, "other", m.ordered(0)[0].name)
+}
+
+func TestMultiClient_QuarantinesLaggingProvider(t *testing.T) {
+	m := NewMultiClient([]Provider{{Name: "behind", Client: &stubClient{}}, {Name: "ahead", Client: &stubClient{}}})
+
+	m.setHead(m.providers[1], 100)
+	m.setHead(m.providers[0], 90)
+	require.True(t, m.providers[0].quarantined(time.Now()))
+	require.False(t, m.providers[1].quarantined(time.Now()))
+	require.Equal(t, "ahead", m.ordered(95)[0].name)
+}
+
+func TestMultiClient_AllFail(t *testing.T) {
+	a := &stubClient{err: errors.New("a down")}
+	b := &stubClient{err: errors.New("b down")}
+	m := NewMultiClient([]Provider{{Name: "a", Client: a}, {Name: "b", Client: b}})
+
+	_, err := m.BatchGetReceipts(context.Background(), []string{"0x1"})
+	require.Error(t, err)
+	require.Equal(t, 1, a.calls)
+	require.Equal(t, 1, b.calls)
+}
@@ -0,0 +1,183 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ARK21/deblock/internal/app/metrics"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// ErrNotFound is returned when the node answers null for a block or receipt,
+// usually because it hasn't seen it yet.
+var ErrNotFound = errors.New("not found")
+
+// RetryPolicy is how one method is retried. Timeout bounds every attempt.
+type RetryPolicy struct {
+	Attempts   int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	Timeout    time.Duration
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{Attempts: 5, Backoff: 200 * time.Millisecond, MaxBackoff: 5 * time.Second, Timeout: 10 * time.Second}
+}
+
+// Retrying is a Client that retries retryable errors of the wrapped Client with
+// jittered exponential backoff. Methods without a policy in Methods use Default.
+type Retrying struct {
+	Client  Client
+	Default RetryPolicy
+	// Methods overrides Default by Client method name, e.g. "TraceBlock".
+	Methods map[string]RetryPolicy
+	Metrics *metrics.Chain
+}
+
+func NewRetrying(c Client, def RetryPolicy) *Retrying {
+	return &Retrying{
+		Client:  c,
+		Default: def,
+		Methods: map[string]RetryPolicy{
+			// traces are slow to produce and optional; don't hold the block up for long
+			"TraceBlock": {Attempts: 2, Backoff: def.Backoff, MaxBackoff: def.MaxBackoff, Timeout: 3 * def.Timeout},
+		},
+	}
+}
+
+// Retryable reports whether err may go away by itself: null results and
+// "header not found" from a node that is behind, timeouts, rate limits,
+// 5xx and dropped connections. Bad requests and missing capabilities are permanent.
+func Retryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) ||
+		errors.Is(err, ErrTracesUnavailable) || errors.Is(err, ErrBlockReceiptsUnavailable) {
+		return false
+	}
+	if errors.Is(err, ErrNotFound) || errors.Is(err, context.DeadlineExceeded) || isRateLimited(err) {
+		return true
+	}
+	var httpErr rpc.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode >= 500
+	}
+	var rpcErr rpc.Error
+	if errors.As(err, &rpcErr) {
+		switch rpcErr.ErrorCode() {
+		case -32600, -32601, -32602: // invalid request, method not found, invalid params
+			return false
+		case -32000: // geth's catch-all server error, e.g. "header not found"
+			return true
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"header not found", "unknown block", "timeout", "connection reset", "eof"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Retrying) policy(method string) RetryPolicy {
+	if p, ok := r.Methods[method]; ok {
+		return p
+	}
+	return r.Default
+}
+
+func retry[T any](ctx context.Context, r *Retrying, method string, fn func(context.Context) (T, error)) (T, error) {
+	p := r.policy(method)
+	backoff := p.Backoff
+	for attempt := 1; ; attempt++ {
+		actx, cancel := ctx, context.CancelFunc(func() {})
+		if p.Timeout > 0 {
+			actx, cancel = context.WithTimeout(ctx, p.Timeout)
+		}
+		v, err := fn(actx)
+		cancel()
+		if err == nil || ctx.Err() != nil || attempt >= p.Attempts || !Retryable(err) {
+			return v, err
+		}
+		r.Metrics.RPCRetry(method)
+
+		// full jitter over the current backoff
+		wait := time.Duration(rand.Int63n(int64(max(backoff, 0))+1)) + time.Millisecond
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return v, err
+		}
+		backoff = min(2*backoff, p.MaxBackoff)
+	}
+}
+
+// SubscribeNewHeads isn't retried; heads.Source already resubscribes with backoff.
+func (r *Retrying) SubscribeNewHeads(ctx context.Context) (<-chan Header, <-chan error) {
+	return r.Client.SubscribeNewHeads(ctx)
+}
+
+func (r *Retrying) GetBlockByHash(ctx context.Context, hash string, fullTx bool) (Block, error) {
+	return retry(ctx, r, "GetBlockByHash", func(ctx context.Context) (Block, error) {
+		return r.Client.GetBlockByHash(ctx, hash, fullTx)
+	})
+}
+
+func (r *Retrying) GetBlockByTag(ctx context.Context, tag string, fullTx bool) (Block, error) {
+	return retry(ctx, r, "GetBlockByTag", func(ctx context.Context) (Block, error) {
+		return r.Client.GetBlockByTag(ctx, tag, fullTx)
+	})
+}
+
+func (r *Retrying) GetBlockByNumber(ctx context.Context, number uint64, fullTx bool) (Block, error) {
+	return retry(ctx, r, "GetBlockByNumber", func(ctx context.Context) (Block, error) {
+		return r.Client.GetBlockByNumber(ctx, number, fullTx)
+	})
+}
+
+func (r *Retrying) GetTxReceipt(ctx context.Context, txHash string) (Receipt, error) {
+	return retry(ctx, r, "GetTxReceipt", func(ctx context.Context) (Receipt, error) {
+		return r.Client.GetTxReceipt(ctx, txHash)
+	})
+}
+
+func (r *Retrying) GetChainID(ctx context.Context) (uint64, error) {
+	return retry(ctx, r, "GetChainID", r.Client.GetChainID)
+}
+
+func (r *Retrying) GetBlockNumber(ctx context.Context) (uint64, error) {
+	return retry(ctx, r, "GetBlockNumber", r.Client.GetBlockNumber)
+}
+
+func (r *Retrying) BatchGetReceipts(ctx context.Context, hashes []string) (map[string]Receipt, error) {
+	return retry(ctx, r, "BatchGetReceipts", func(ctx context.Context) (map[string]Receipt, error) {
+		return r.Client.BatchGetReceipts(ctx, hashes)
+	})
+}
+
+func (r *Retrying) GetBlockReceipts(ctx context.Context, blockHash string) (map[string]Receipt, error) {
+	return retry(ctx, r, "GetBlockReceipts", func(ctx context.Context) (map[string]Receipt, error) {
+		return r.Client.GetBlockReceipts(ctx, blockHash)
+	})
+}
+
+func (r *Retrying) TraceBlock(ctx context.Context, number uint64, hash string) ([]TraceFrame, error) {
+	return retry(ctx, r, "TraceBlock", func(ctx context.Context) ([]TraceFrame, error) {
+		return r.Client.TraceBlock(ctx, number, hash)
+	})
+}
+
+// Close closes the wrapped client.
+func (r *Retrying) Close() { Close(r.Client) }
+
+// Parallelism passes through the wrapped client's parallelism.
+func (r *Retrying) Parallelism() int { return Parallelism(r.Client) }
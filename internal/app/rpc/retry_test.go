@@ -0,0 +1,86 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyClient fails GetBlockByNumber with errs, in order, before succeeding.
+type flakyClient struct {
+	stubClient
+	errs []error
+}
+
+func (f *flakyClient) GetBlockByNumber(_ context.Context, n uint64, _ bool) (Block, error) {
+	f.calls++
+	if len(f.errs) > 0 {
+		err := f.errs[0]
+		f.errs = f.errs[1:]
+		return Block{}, err
+	}
+	return Block{Number: n}, nil
+}
+
+func testPolicy() RetryPolicy {
+	return RetryPolicy{Attempts: 4, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond, Timeout: time.Second}
+}
+
+func TestRetrying_RetriesTransientErrors(t *testing.T) {
+	c := &flakyClient{errs: []error{
+		ErrNotFound,
+		errors.New("header not found"),
+		rpc.HTTPError{StatusCode: http.StatusServiceUnavailable},
+	}}
+	r := NewRetrying(c, testPolicy())
+
+	blk, err := r.GetBlockByNumber(context.Background(), 7, true)
+	require.NoError(t, err)
+	require.Equal(t, uint64(7), blk.Number)
+	require.Equal(t, 4, c.calls)
+}
+
+func TestRetrying_GivesUp(t *testing.T) {
+	c := &flakyClient{errs: []error{ErrNotFound, ErrNotFound, ErrNotFound, ErrNotFound, ErrNotFound}}
+	r := NewRetrying(c, testPolicy())
+
+	_, err := r.GetBlockByNumber(context.Background(), 7, true)
+	require.ErrorIs(t, err, ErrNotFound)
+	require.Equal(t, 4, c.calls)
+}
+
+func TestRetrying_PermanentErrorsFailFast(t *testing.T) {
+	c := &flakyClient{errs: []error{rpc.HTTPError{StatusCode: http.StatusUnauthorized}}}
+	r := NewRetrying(c, testPolicy())
+
+	_, err := r.GetBlockByNumber(context.Background(), 7, true)
+	require.Error(t, err)
+	require.Equal(t, 1, c.calls)
+}
+
+func TestRetryable(t *testing.T) {
+	for _, err := range []error{
+		ErrNotFound,
+		fmt.Errorf("receipt 0x1: %w", ErrNotFound),
+		context.DeadlineExceeded,
+		rpc.HTTPError{StatusCode: http.StatusBadGateway},
+		rpc.HTTPError{StatusCode: http.StatusTooManyRequests},
+		errors.New("header not found"),
+	} {
+		require.True(t, Retryable(err), err.Error())
+	}
+	for _, err := range []error{
+		context.Canceled,
+		ErrTracesUnavailable,
+		rpc.HTTPError{StatusCode: http.StatusBadRequest},
+		errors.New("invalid argument 0: hex string without 0x prefix"),
+	} {
+		require.False(t, Retryable(err), err.Error())
+	}
+}
@@ -0,0 +1,135 @@
+package users
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	OpAdd    = "add"
+	OpRemove = "remove"
+)
+
+// JournalEntry is one address change made at runtime.
+type JournalEntry struct {
+	Op      string    `json:"op"`
+	Address string    `json:"address"`
+	UserID  string    `json:"user_id,omitempty"`
+	Label   string    `json:"label,omitempty"`
+	Tags    []string  `json:"tags,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// Journal is an append-only JSON-lines log of runtime address changes.
+// It is replayed on top of the CSV at boot and on every reload.
+type Journal struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewJournal(path string) *Journal {
+	_ = os.MkdirAll(filepath.Dir(path), 0o755)
+	return &Journal{path: path}
+}
+
+// Append durably writes e before returning.
+func (j *Journal) Append(e JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(j.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Replay calls fn for every entry in order, with the address checksummed. A missing journal is empty.
+// A crash during Append can leave the last line without its newline: if it is
+// cut short it is dropped, else completed, so the next Append starts a line of its own.
+func (j *Journal) Replay(fn func(JournalEntry)) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	f, err := os.Open(j.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	n := 0
+	r := bufio.NewReader(f)
+	var off int64
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return n, err
+		}
+		if len(b) == 0 {
+			return n, nil
+		}
+		torn := b[len(b)-1] != '\n'
+		if text := bytes.TrimSpace(b); len(text) > 0 {
+			var e JournalEntry
+			err := json.Unmarshal(text, &e)
+			if err == nil && e.Op != OpAdd && e.Op != OpRemove {
+				err = fmt.Errorf("unknown op %q", e.Op)
+			}
+			if err != nil && torn {
+				log.Printf("[users] journal %s line %d: dropping torn entry: %v", j.path, line, err)
+				return n, os.Truncate(j.path, off)
+			}
+			if err != nil {
+				return n, fmt.Errorf("journal %s line %d: %w", j.path, line, err)
+			}
+			e.Address = common.HexToAddress(e.Address).Hex()
+			fn(e)
+			n++
+		}
+		if torn {
+			return n, j.endLine()
+		}
+		off += int64(len(b))
+	}
+}
+
+// endLine terminates the journal's last line.
+func (j *Journal) endLine() error {
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte{'\n'}); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Entry returns the filter entry an add records.
+func (e JournalEntry) Entry() filter.Entry {
+	return filter.Entry{UserID: e.UserID, Label: e.Label, Tags: e.Tags}
+}
@@ -0,0 +1,61 @@
+package users
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJournal_TornLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	a := "0x000000000000000000000000000000000000dEaD"
+	b := "0x000000000000000000000000000000000000bEEF"
+	j := NewJournal(path)
+	require.NoError(t, j.Append(JournalEntry{Op: OpAdd, Address: a, UserID: "u1"}))
+
+	// a crash cut the second append short
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	_, err = f.WriteString(`{"op":"add","address":"` + b)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	var got []string
+	n, err := j.Replay(func(e JournalEntry) { got = append(got, e.Address) })
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+	require.Equal(t, []string{a}, got)
+
+	// the torn entry is gone, so the next append is a line of its own
+	require.NoError(t, j.Append(JournalEntry{Op: OpRemove, Address: a}))
+	got = nil
+	n, err = j.Replay(func(e JournalEntry) { got = append(got, e.Op) })
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+	require.Equal(t, []string{OpAdd, OpRemove}, got)
+}
+
+func TestJournal_MissingLastNewline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	a := "0x000000000000000000000000000000000000dEaD"
+	require.NoError(t, os.WriteFile(path, []byte(`{"op":"add","address":"`+a+`","user_id":"u1"}`), 0o644))
+	j := NewJournal(path)
+
+	n, err := j.Replay(func(JournalEntry) {})
+	require.NoError(t, err)
+	require.Equal(t, 1, n)
+
+	require.NoError(t, j.Append(JournalEntry{Op: OpRemove, Address: a}))
+	n, err = j.Replay(func(JournalEntry) {})
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+}
+
+func TestJournal_CorruptLineFails(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	require.NoError(t, os.WriteFile(path, []byte("{oops\n"), 0o644))
+	_, err := NewJournal(path).Replay(func(JournalEntry) {})
+	require.ErrorContains(t, err, "line 1")
+}
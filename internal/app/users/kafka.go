@@ -0,0 +1,122 @@
+package users
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/ARK21/deblock/internal/app/kafka"
+	"github.com/ARK21/deblock/internal/app/metrics"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AddressRecord is the value of an address assignment on the registry topic.
+// The message key is the address; an empty value (tombstone) removes it.
+type AddressRecord struct {
+	UserID string   `json:"user_id"`
+	Label  string   `json:"label,omitempty"`
+	Tags   []string `json:"tags,omitempty"`
+}
+
+// KafkaSource builds the address set from a compacted topic and applies
+// upserts and tombstones published after startup.
+type KafkaSource struct {
+	Brokers []string
+	Topic   string
+
+	msgs <-chan *message.Message
+}
+
+var _ Source = (*KafkaSource)(nil)
+
+func NewKafkaSource(brokers []string, topic string) *KafkaSource {
+	return &KafkaSource{Brokers: brokers, Topic: topic}
+}
+
+// Load reads the topic up to the end offsets seen at startup and only then returns,
+// so no block is processed against a partial registry.
+func (s *KafkaSource) Load(ctx context.Context) (*filter.Matcher, error) {
+	end, err := kafka.EndOffsets(s.Brokers, s.Topic)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := kafka.NewTopicReader(s.Brokers)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := sub.Subscribe(ctx, s.Topic)
+	if err != nil {
+		return nil, fmt.Errorf("subscribe %s: %w", s.Topic, err)
+	}
+	log.Printf("[users] reading %s up to %v", s.Topic, end)
+
+	entries := make(map[string]filter.Entry)
+	err = kafka.CatchUp(ctx, msgs, end, kafka.CatchUpIdle, kafka.VerifyTail(s.Brokers, s.Topic, kafka.CatchUpIdle), func(msg *message.Message) {
+		if addr, e, ok := decodeAddressRecord(msg); ok {
+			if e.UserID == "" {
+				delete(entries, addr)
+			} else {
+				entries[addr] = e
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.Topic, err)
+	}
+	s.msgs = msgs
+
+	m := filter.NewEntryMatcher(entries)
+	metrics.SetAddressesTracked(m.Len())
+	log.Printf("[users] registry caught up: %d addresses", m.Len())
+	return m, nil
+}
+
+// Watch applies records arriving after Load to the live Matcher in place.
+func (s *KafkaSource) Watch(ctx context.Context, live *filter.Live) {
+	for {
+		select {
+		case msg, ok := <-s.msgs:
+			if !ok {
+				log.Printf("[users] subscription to %s closed, address set frozen", s.Topic)
+				return
+			}
+			if addr, e, ok := decodeAddressRecord(msg); ok {
+				m := live.Current()
+				if e.UserID == "" {
+					if m.Remove(addr) {
+						metrics.AddressesChanged(0, 1)
+					}
+				} else {
+					m.Add(addr, e)
+					metrics.AddressesChanged(1, 0)
+				}
+				metrics.SetAddressesTracked(m.Len())
+			}
+			msg.Ack()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// decodeAddressRecord returns the address and entry of msg; a tombstone yields an empty entry.
+func decodeAddressRecord(msg *message.Message) (string, filter.Entry, bool) {
+	key := kafka.MessageKey(msg)
+	if !common.IsHexAddress(key) {
+		log.Printf("[users] skipping record with invalid address key %q", key)
+		return "", filter.Entry{}, false
+	}
+	addr := common.HexToAddress(key).Hex()
+	if len(msg.Payload) == 0 {
+		return addr, filter.Entry{}, true
+	}
+	var rec AddressRecord
+	if err := json.Unmarshal(msg.Payload, &rec); err != nil || rec.UserID == "" {
+		log.Printf("[users] skipping invalid record for %s: %v", addr, err)
+		return "", filter.Entry{}, false
+	}
+	return addr, filter.Entry{UserID: rec.UserID, Label: rec.Label, Tags: rec.Tags}, true
+}
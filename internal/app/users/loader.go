@@ -2,38 +2,147 @@ package users
 
 import (
 	"encoding/csv"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"strings"
+
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/ethereum/go-ethereum/common"
 )
 
-func LoadUsers(file string) map[string]string {
+// maxProblems caps how many row problems a Report keeps for logging.
+const maxProblems = 20
+
+// Report summarises an address file load. Rejected rows are counted, not fatal.
+type Report struct {
+	Rows        int
+	Addresses   int
+	Users       int
+	Invalid     int // unparsable address or missing user_id
+	BadChecksum int // mixed-case address failing EIP-55
+	Duplicates  int // address listed again for the same user
+	Conflicts   int // address listed again for another user; the first row wins
+	Problems    []string
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("rows=%d addresses=%d users=%d invalid=%d bad_checksum=%d duplicates=%d conflicts=%d",
+		r.Rows, r.Addresses, r.Users, r.Invalid, r.BadChecksum, r.Duplicates, r.Conflicts)
+}
+
+func (r *Report) problem(line int, format string, args ...any) {
+	if len(r.Problems) < maxProblems {
+		r.Problems = append(r.Problems, fmt.Sprintf("line %d: ", line)+fmt.Sprintf(format, args...))
+	}
+}
+
+// ReadUsers loads the address file. See ParseUsers for the format.
+func ReadUsers(file string) (map[string]filter.Entry, Report, error) {
 	f, err := os.Open(file)
 	if err != nil {
-		log.Fatal(err)
+		return nil, Report{}, err
 	}
 	defer f.Close()
+	return ParseUsers(f)
+}
 
-	reader := csv.NewReader(f)
-
-	users := make(map[string]string, 512_000)
+// ParseUsers reads address,user_id[,label[,tags]] rows; tags are ';'-separated.
+// A header row is optional; when present its column names (address, user_id,
+// label, tags) decide the order. Keys of the result are checksummed addresses.
+func ParseUsers(r io.Reader) (map[string]filter.Entry, Report, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
 
-	if _, err := reader.Read(); err != nil {
-		log.Fatal("Error reading header")
+	cols := map[string]int{"address": 0, "user_id": 1, "label": 2, "tags": 3}
+	field := func(rec []string, name string) string {
+		if i, ok := cols[name]; ok && i < len(rec) {
+			return strings.TrimSpace(rec[i])
+		}
+		return ""
 	}
 
-	for i := 0; i < 500_000; i++ {
-		records, err := reader.Read()
+	users := make(map[string]filter.Entry, 512_000)
+	owners := make(map[string]struct{})
+	var rep Report
+
+	for first := true; ; first = false {
+		rec, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		var perr *csv.ParseError
+		if errors.As(err, &perr) {
+			rep.Rows++
+			rep.Invalid++
+			rep.problem(perr.Line, "%v", perr.Err)
+			continue
+		}
 		if err != nil {
-			if err.Error() == "EOF" {
-				break
+			return nil, rep, err
+		}
+		line, _ := reader.FieldPos(0)
+
+		// a first row naming an address column is a header; anything else is data
+		if header := headerColumns(rec); first && header != nil {
+			cols = header
+			if _, ok := cols["user_id"]; !ok {
+				return nil, rep, fmt.Errorf("header has no user_id column: %v", rec)
+			}
+			continue
+		}
+
+		rep.Rows++
+		raw := field(rec, "address")
+		uid := field(rec, "user_id")
+		if !common.IsHexAddress(raw) || uid == "" {
+			rep.Invalid++
+			rep.problem(line, "invalid row %q", strings.Join(rec, ","))
+			continue
+		}
+		addr := common.HexToAddress(raw).Hex()
+		if hex := strings.TrimPrefix(strings.TrimPrefix(raw, "0x"), "0X"); hex != strings.ToLower(hex) && hex != strings.ToUpper(hex) && "0x"+hex != addr {
+			rep.BadChecksum++
+			rep.problem(line, "bad checksum %s", raw)
+			continue
+		}
+		if prev, ok := users[addr]; ok {
+			if prev.UserID == uid {
+				rep.Duplicates++
+			} else {
+				rep.Conflicts++
+				rep.problem(line, "%s already belongs to %s, ignoring %s", addr, prev.UserID, uid)
+			}
+			continue
+		}
+
+		e := filter.Entry{UserID: uid, Label: field(rec, "label")}
+		for _, t := range strings.Split(field(rec, "tags"), ";") {
+			if t = strings.TrimSpace(t); t != "" {
+				e.Tags = append(e.Tags, t)
 			}
-			log.Fatal(err)
 		}
-		users[records[0]] = fmt.Sprintf("%06d", i)
+		users[addr] = e
+		owners[uid] = struct{}{}
 	}
 
-	fmt.Println("loaded", len(users), "users")
+	rep.Addresses = len(users)
+	rep.Users = len(owners)
+	return users, rep, nil
+}
 
-	return users
+// headerColumns returns the column indexes of rec by name if it is a header row,
+// that is if one of its fields is "address".
+func headerColumns(rec []string) map[string]int {
+	cols := make(map[string]int, len(rec))
+	for i, name := range rec {
+		cols[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	if _, ok := cols["address"]; !ok {
+		return nil
+	}
+	return cols
 }
@@ -0,0 +1,74 @@
+package users
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUsers(t *testing.T) {
+	// no header, like the generator in main.go writes
+	in := strings.Join([]string{
+		"0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2,u1,hot wallet,vip;eu",
+		"0xdac17f958d2ee523a2206206994597c13d831ec7,u1", // second address of u1, lower-case is fine
+		"0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2,u1", // duplicate
+		"0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2,u2", // conflict, first row wins
+		"0xDAC17F958D2ee523a2206206994597C13D831ec8,u3", // mixed case, wrong checksum
+		"not-an-address,u4",                                       // invalid
+		"0x000000000000000000000000000000000000dEaD,",             // missing user_id
+		"0x000000000000000000000000000000000000dEaD,u5,,treasury", // tags without label
+	}, "\n")
+
+	users, rep, err := ParseUsers(strings.NewReader(in))
+	require.NoError(t, err)
+	require.Equal(t, 8, rep.Rows)
+	require.Equal(t, 3, rep.Addresses)
+	require.Equal(t, 2, rep.Users)
+	require.Equal(t, 1, rep.Duplicates)
+	require.Equal(t, 1, rep.Conflicts)
+	require.Equal(t, 1, rep.BadChecksum)
+	require.Equal(t, 2, rep.Invalid)
+
+	require.Equal(t, filter.Entry{UserID: "u1", Label: "hot wallet", Tags: []string{"vip", "eu"}},
+		users["0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2"])
+	require.Equal(t, "u1", users["0xdAC17F958D2ee523a2206206994597C13D831ec7"].UserID)
+	require.Equal(t, []string{"treasury"}, users["0x000000000000000000000000000000000000dEaD"].Tags)
+}
+
+func TestParseUsers_Header(t *testing.T) {
+	in := "user_id,label,address\nu9,cold,0x000000000000000000000000000000000000dEaD\n"
+	users, rep, err := ParseUsers(strings.NewReader(in))
+	require.NoError(t, err)
+	require.Equal(t, 1, rep.Addresses)
+	require.Equal(t, filter.Entry{UserID: "u9", Label: "cold"}, users["0x000000000000000000000000000000000000dEaD"])
+
+	// a header naming the address but not the user
+	_, _, err = ParseUsers(strings.NewReader("address,uid\n"))
+	require.Error(t, err)
+}
+
+func TestParseUsers_BadFirstRow(t *testing.T) {
+	// a typo in the first row of a headerless file is just an invalid row
+	in := "0xZZ0000000000000000000000000000000000dEaD,u1\n0x000000000000000000000000000000000000dEaD,u2\n"
+	users, rep, err := ParseUsers(strings.NewReader(in))
+	require.NoError(t, err)
+	require.Equal(t, 2, rep.Rows)
+	require.Equal(t, 1, rep.Invalid)
+	require.Equal(t, "u2", users["0x000000000000000000000000000000000000dEaD"].UserID)
+}
+
+func TestParseUsers_MalformedQuotes(t *testing.T) {
+	in := strings.Join([]string{
+		`"abc`,
+		`0x000000000000000000000000000000000000dEaD,u1`,
+		`a"bc,u1`,
+		`0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2,u2`,
+	}, "\n")
+	users, rep, err := ParseUsers(strings.NewReader(in))
+	require.NoError(t, err)
+	require.Positive(t, rep.Invalid)
+	require.NotEmpty(t, rep.Problems)
+	require.Equal(t, "u2", users["0xC02aaA39b223FE8D0A0e5C4F27eAD9083C756Cc2"].UserID)
+}
@@ -0,0 +1,200 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/ARK21/deblock/internal/app/metrics"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Source supplies the tracked address set and keeps a live Matcher up to date.
+type Source interface {
+	// Load builds the initial Matcher.
+	Load(ctx context.Context) (*filter.Matcher, error)
+	// Watch swaps updated Matchers into live until ctx is done.
+	Watch(ctx context.Context, live *filter.Live)
+}
+
+// FileSource reads the address CSV and reloads it when the file changes or on SIGHUP.
+// When Index is set, the prebuilt index (see cmd/addrindex) is mapped instead of the CSV.
+// Changes recorded in Journal are replayed on top of either.
+type FileSource struct {
+	Path         string
+	Index        string
+	PollInterval time.Duration
+	Journal      *Journal
+
+	// mu orders reloads against runtime changes, so a change is never lost to a concurrent swap.
+	mu   sync.Mutex
+	mod  time.Time
+	size int64
+}
+
+var _ Source = (*FileSource)(nil)
+
+func NewFileSource(path string, pollInterval time.Duration) *FileSource {
+	if pollInterval <= 0 {
+		pollInterval = 10 * time.Second
+	}
+	return &FileSource{Path: path, PollInterval: pollInterval}
+}
+
+func (s *FileSource) Load(ctx context.Context) (*filter.Matcher, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.load()
+}
+
+func (s *FileSource) load() (*filter.Matcher, error) {
+	s.mod, s.size = s.stat()
+	var m *filter.Matcher
+	if s.Index != "" {
+		idx, err := filter.OpenIndex(s.Index)
+		if err != nil {
+			return nil, err
+		}
+		m = filter.NewIndexMatcher(idx)
+		log.Printf("[users] mapped %s: addresses=%d", s.Index, idx.Len())
+	} else {
+		u, rep, err := ReadUsers(s.Path)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("[users] loaded %s: %s", s.Path, rep)
+		for _, p := range rep.Problems {
+			log.Printf("[users] %s", p)
+		}
+		m = filter.NewEntryMatcher(u)
+	}
+	if s.Journal != nil {
+		n, err := s.Journal.Replay(func(e JournalEntry) {
+			if e.Op == OpAdd {
+				m.Add(e.Address, e.Entry())
+			} else {
+				m.Remove(e.Address)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		if n > 0 {
+			log.Printf("[users] replayed %d journal entries", n)
+		}
+	}
+	metrics.SetAddressesTracked(m.Len())
+	return m, nil
+}
+
+func (s *FileSource) Watch(ctx context.Context, live *filter.Live) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	t := time.NewTicker(s.PollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-hup:
+			log.Printf("[users] SIGHUP, reloading %s", s.watched())
+			s.reload(ctx, live)
+		case <-t.C:
+			if mod, size := s.stat(); !mod.Equal(s.mod) || size != s.size {
+				log.Printf("[users] %s changed, reloading", s.watched())
+				s.reload(ctx, live)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reload builds the new Matcher off the hot path and swaps it in; on error the current set stays.
+func (s *FileSource) reload(ctx context.Context, live *filter.Live) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next, err := s.load()
+	if err != nil {
+		log.Printf("[users] reload failed, keeping current set: %v", err)
+		metrics.AddressReload(false)
+		return
+	}
+	prev := live.Swap(next)
+	added, removed := filter.Diff(prev, next)
+	metrics.AddressReload(true)
+	metrics.AddressesChanged(added, removed)
+	log.Printf("[users] reloaded %d addresses (+%d -%d)", next.Len(), added, removed)
+}
+
+// Add tracks addr for e.UserID in live and records the change in the journal.
+func (s *FileSource) Add(live *filter.Live, addr string, e filter.Entry) error {
+	return s.apply(live, JournalEntry{Op: OpAdd, Address: addr, UserID: e.UserID, Label: e.Label, Tags: e.Tags})
+}
+
+// Remove stops tracking addr in live and records the change in the journal.
+func (s *FileSource) Remove(live *filter.Live, addr string) error {
+	return s.apply(live, JournalEntry{Op: OpRemove, Address: addr})
+}
+
+func (s *FileSource) apply(live *filter.Live, e JournalEntry) error {
+	if s.Journal == nil {
+		return errors.New("address journal not configured")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e.Address = common.HexToAddress(e.Address).Hex()
+	e.At = time.Now().UTC()
+	if err := s.Journal.Append(e); err != nil {
+		return fmt.Errorf("journal append: %w", err)
+	}
+	m := live.Current()
+	switch e.Op {
+	case OpAdd:
+		m.Add(e.Address, e.Entry())
+		metrics.AddressesChanged(1, 0)
+	case OpRemove:
+		if m.Remove(e.Address) {
+			metrics.AddressesChanged(0, 1)
+		}
+	}
+	metrics.SetAddressesTracked(m.Len())
+	log.Printf("[users] %s %s %s", e.Op, e.Address, e.UserID)
+	return nil
+}
+
+// watched is the file whose changes trigger a reload.
+func (s *FileSource) watched() string {
+	if s.Index != "" {
+		return s.Index
+	}
+	return s.Path
+}
+
+func (s *FileSource) stat() (time.Time, int64) {
+	fi, err := os.Stat(s.watched())
+	if err != nil {
+		return time.Time{}, 0
+	}
+	return fi.ModTime(), fi.Size()
+}
+
+// Registry binds a FileSource to the live set it feeds, for runtime edits.
+type Registry struct {
+	Source *FileSource
+	Live   *filter.Live
+}
+
+func (r Registry) Add(addr string, e filter.Entry) error { return r.Source.Add(r.Live, addr, e) }
+
+func (r Registry) Remove(addr string) error { return r.Source.Remove(r.Live, addr) }
+
+func (r Registry) Lookup(addr string) (filter.Entry, bool) { return r.Live.Current().Lookup(addr) }
@@ -0,0 +1,40 @@
+package users
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileSource_ReloadSwapsMatcher(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "addresses.csv")
+	a := "0x000000000000000000000000000000000000dEaD"
+	b := "0x000000000000000000000000000000000000bEEF"
+
+	require.NoError(t, os.WriteFile(path, []byte("address,user_id\n"+a+",u1\n"), 0o644))
+	src := NewFileSource(path, 0)
+	m, err := src.Load(ctx)
+	require.NoError(t, err)
+	live := filter.NewLive(m)
+
+	_, _, ok := live.Current().Match(b, nil)
+	require.False(t, ok)
+
+	require.NoError(t, os.WriteFile(path, []byte("address,user_id\n"+b+",u2\n"), 0o644))
+	src.reload(ctx, live)
+	_, _, ok = live.Current().Match(b, nil)
+	require.True(t, ok)
+	_, _, ok = live.Current().Match(a, nil)
+	require.False(t, ok)
+
+	// a broken file keeps the current set
+	require.NoError(t, os.Remove(path))
+	src.reload(ctx, live)
+	_, _, ok = live.Current().Match(b, nil)
+	require.True(t, ok)
+}
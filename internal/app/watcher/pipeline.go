@@ -0,0 +1,400 @@
+package watcher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/ARK21/deblock/internal/app/backfill"
+	"github.com/ARK21/deblock/internal/app/checkpoint"
+	"github.com/ARK21/deblock/internal/app/config"
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/ARK21/deblock/internal/app/heads"
+	"github.com/ARK21/deblock/internal/app/kafka"
+	"github.com/ARK21/deblock/internal/app/metrics"
+	"github.com/ARK21/deblock/internal/app/processor"
+	"github.com/ARK21/deblock/internal/app/reorg"
+	"github.com/ARK21/deblock/internal/app/rpc"
+)
+
+// Pipeline watches one chain: it backfills from its checkpoint, then follows
+// finalized heads. Pipelines of different chains share the matcher and the bus.
+type Pipeline struct {
+	Chain     config.ChainConfig
+	Conf      config.Config
+	Matcher   filter.Provider
+	EventBus  kafka.Publisher
+	Client    rpc.Client
+	Metrics   *metrics.Chain
+	Store     *checkpoint.FileStore
+	Service   *processor.Service
+	Finality  heads.Finality
+	Finalizer *heads.Finalizer
+	Reorg     *reorg.Manager
+
+	// pending holds finalized heads not processed yet because an RPC call failed
+	// even after retries; they are retried in order on the next head.
+	pending []heads.Header
+	// finalized is the last block whose events were delivered
+	finalized uint64
+}
+
+// NewPipeline dials the chain's endpoints and builds its components.
+func NewPipeline(ctx context.Context, chain config.ChainConfig, conf config.Config, matcher filter.Provider, bus kafka.Publisher) (*Pipeline, error) {
+	m := metrics.ForChain(chain.Name)
+	client, err := dial(ctx, chain, conf, m)
+	if err != nil {
+		return nil, err
+	}
+
+	chainID, err := client.GetChainID(ctx)
+	if err != nil {
+		rpc.Close(client)
+		return nil, fmt.Errorf("get chain ID: %w", err)
+	}
+	srv := processor.NewService(client, matcher, bus, chainID)
+	srv.Tokens = conf.TrackTokens
+	srv.Metrics = m
+	mgr := reorg.NewManager(chain.ReorgDepth)
+	mgr.DeepPolicy = conf.DeepReorgPolicy
+	mgr.MaxSearch = uint64(conf.DeepReorgMaxDepth)
+	srv.OnDelivered = mgr.Remember
+	fin, err := newFinality(chain, client)
+	if err != nil {
+		rpc.Close(client)
+		return nil, err
+	}
+	finalizer := heads.NewFinalizer(client, fin)
+	finalizer.Metrics = m
+
+	return &Pipeline{
+		Chain:     chain,
+		Conf:      conf,
+		Matcher:   matcher,
+		EventBus:  bus,
+		Client:    client,
+		Metrics:   m,
+		Store:     checkpoint.NewFileStore(chain.CheckpointFile),
+		Service:   srv,
+		Finality:  fin,
+		Finalizer: finalizer,
+		Reorg:     mgr,
+	}, nil
+}
+
+// Close releases the chain's RPC connections.
+func (p *Pipeline) Close() { rpc.Close(p.Client) }
+
+// dial connects to the chain's providers and wraps them in the retry policy.
+func dial(ctx context.Context, chain config.ChainConfig, conf config.Config, m *metrics.Chain) (rpc.Client, error) {
+	client, err := dialProviders(ctx, chain, conf, m)
+	if err != nil {
+		return nil, err
+	}
+	r := rpc.NewRetrying(client, rpc.RetryPolicy{
+		Attempts:   conf.RPCRetryAttempts,
+		Backoff:    conf.RPCRetryBackoff,
+		MaxBackoff: conf.RPCRetryMaxBackoff,
+		Timeout:    conf.RPCCallTimeout,
+	})
+	r.Metrics = m
+	return r, nil
+}
+
+// dialProviders connects to the chain's providers. Several providers are wrapped
+// in a MultiClient whose head probe runs until ctx is done.
+func dialProviders(ctx context.Context, chain config.ChainConfig, conf config.Config, m *metrics.Chain) (rpc.Client, error) {
+	providers := make([]rpc.Provider, 0, len(chain.Providers))
+	for _, pc := range chain.Providers {
+		c, err := rpc.NewGethClient(ctx, pc.WsURL, pc.HttpUrl)
+		if err != nil {
+			for _, p := range providers {
+				rpc.Close(p.Client)
+			}
+			return nil, fmt.Errorf("rpc %s: %w", pc.Name, err)
+		}
+		c.TraceMode = chain.TraceMode
+		c.Metrics = m
+		if len(chain.Providers) > 1 {
+			c.Metrics = m.Provider(pc.Name)
+		}
+		// budgets are per provider: each has its own quota
+		c.Limiter = rpc.NewLimiter(budgets(conf.RPCBudgets))
+		c.Limiter.Metrics = c.Metrics
+		if len(chain.Providers) == 1 {
+			return c, nil
+		}
+		providers = append(providers, rpc.Provider{Name: pc.Name, Client: c})
+	}
+	multi := rpc.NewMultiClient(providers)
+	multi.MaxLag = uint64(conf.RPCMaxLag)
+	multi.Quarantine = conf.RPCQuarantine
+	multi.Metrics = m
+	go multi.Run(ctx, conf.HeadPollInterval)
+	return multi, nil
+}
+
+// newFinality returns the chain's finality strategy.
+func newFinality(chain config.ChainConfig, client rpc.Client) (heads.Finality, error) {
+	switch chain.Finality {
+	case "", "confirmations":
+		return heads.Confirmations{N: uint64(chain.Confirmations)}, nil
+	case "finalized", "safe":
+		return heads.BlockTag{Client: client, Tag: chain.Finality}, nil
+	case "beacon":
+		if chain.BeaconURL == "" {
+			return nil, fmt.Errorf("finality beacon needs a beacon_url")
+		}
+		return heads.Beacon{URL: chain.BeaconURL}, nil
+	}
+	return nil, fmt.Errorf("unknown finality %q", chain.Finality)
+}
+
+func budgets(conf map[string]float64) []rpc.Budget {
+	out := make([]rpc.Budget, 0, len(conf))
+	for method, rate := range conf {
+		out = append(out, rpc.Budget{Method: method, Rate: rate})
+	}
+	return out
+}
+
+// Probe enables the optional node features the provider supports, using block head.
+func (p *Pipeline) Probe(ctx context.Context, head uint64) {
+	client, srv := p.Client, p.Service
+	tip, err := client.GetBlockByNumber(ctx, head, false)
+	if err != nil {
+		p.logf("probe block %d: %v, tracing and block receipts disabled", head, err)
+		return
+	}
+	if p.Chain.TraceMode != rpc.TraceOff {
+		// without trace support we keep watching top-level txs only
+		if _, err := client.TraceBlock(ctx, tip.Number, tip.Hash); err != nil {
+			p.logf("tracing disabled, internal transfers won't be reported: %v", err)
+		} else {
+			srv.Traces = true
+		}
+	}
+	// older nodes only answer receipts by tx hash
+	if _, err := client.GetBlockReceipts(ctx, tip.Hash); err != nil {
+		p.logf("eth_getBlockReceipts unavailable, batching receipts by hash: %v", err)
+	} else {
+		srv.BlockReceipts = true
+	}
+}
+
+func (p *Pipeline) logf(format string, args ...any) {
+	log.Printf("[%s] "+format, append([]any{p.Chain.Name}, args...)...)
+}
+
+// Run backfills and then processes finalized heads until ctx is done.
+// It returns an error wrapping backfill.ErrNoAncestor when a deep reorg halted the chain.
+func (p *Pipeline) Run(ctx context.Context) (err error) {
+	defer func() {
+		if errors.Is(err, backfill.ErrNoAncestor) {
+			// keep the halt in the checkpoint for the operator
+			p.save(ctx, p.finalized)
+		}
+	}()
+
+	client, srv, fs := p.Client, p.Service, p.Store
+	reorgMgr, finalizer := p.Reorg, p.Finalizer
+
+	st, err := fs.Load(ctx)
+	if err != nil {
+		return fmt.Errorf("checkpoint load: %w", err)
+	}
+	p.logf("checkpoint: last_finalized=%d chain_id=%d", st.LastFinalized, srv.ChainID)
+
+	head, target, err := p.Target(ctx)
+	if err != nil {
+		return err
+	}
+
+	p.Probe(ctx, head)
+	reorgMgr.Restore(st.Window)
+	reorgMgr.LastDeep = st.DeepReorg
+	reorgMgr.Retracting = st.PendingRetractions
+	p.finalized = st.LastFinalized
+	if err := p.reconcile(ctx, st.LastFinalized); err != nil {
+		return fmt.Errorf("reconcile checkpoint: %w", err)
+	}
+
+	// If first run with no checkpoint, optionally limit bootstrap depth
+	bootstrap := uint64(p.Chain.BootstrapBlocks) // e.g., 0 (all) or 5000
+	start := st.LastFinalized + 1
+	if st.LastFinalized == 0 && bootstrap > 0 && target > bootstrap {
+		start = target - bootstrap + 1
+	}
+	if start <= target {
+		p.logf("backfill: %d -> %d (target finalized)", start, target)
+		var lastSaved time.Time
+		save := func(n uint64) {
+			p.finalized = n
+			// throttle saves to disk (e.g., every 250ms)
+			if time.Since(lastSaved) < 250*time.Millisecond {
+				return
+			}
+			p.save(ctx, n)
+			lastSaved = time.Now()
+		}
+		if err := backfill.Run(ctx, client, srv, reorgMgr, start, target, p.Conf.BackfillWorkers, save); err != nil {
+			return fmt.Errorf("backfill: %w", err)
+		}
+		// ensure final save
+		p.save(ctx, target)
+		p.logf("backfill done up to %d", target)
+	} else {
+		p.logf("no backfill needed (checkpoint at %d, target %d)", st.LastFinalized, target)
+	}
+
+	// live heads continue from the last finalized block, whatever head they start at
+	if p.finalized > 0 {
+		hash, _ := reorgMgr.Hash(p.finalized)
+		finalizer.Anchor(p.finalized, hash)
+	}
+
+	src := heads.NewSource(client, p.Conf.HeadPollInterval, p.Conf.WSReconnectFloor, p.Conf.WSReconnectCeil)
+	src.Metrics = p.Metrics
+
+	hch, ech := src.Run(ctx)
+	p.logf("subscribed to newHeads (finality=%s)", p.Finality.Name())
+
+	for {
+		select {
+		case h, ok := <-hch:
+			if !ok {
+				p.logf("heads channel closed")
+				return nil
+			}
+			header := heads.Header{
+				Hash:       h.Hash,
+				ParentHash: h.ParentHash,
+				Number:     h.Number,
+			}
+			p.logf("handeling new head: %s (parent=%s, number=%d)", header.Hash, header.ParentHash, header.Number)
+			fhs, err := finalizer.Add(ctx, header)
+			if err != nil {
+				p.logf("finalizer: %v", err)
+			}
+			p.pending = append(p.pending, fhs...)
+			for len(p.pending) > 0 {
+				fh := p.pending[0]
+				if err := p.finalize(ctx, fh); err != nil {
+					if errors.Is(err, backfill.ErrNoAncestor) {
+						return err
+					}
+					p.logf("block %d not finalized, retrying on next head: %v", fh.Number, err)
+					break
+				}
+				p.pending = p.pending[1:]
+			}
+		case err := <-ech:
+			p.logf("newHeads err: %v", err)
+		case <-ctx.Done():
+			p.logf("shutdown")
+			return nil
+		}
+	}
+}
+
+// Target returns the chain head and the highest block final by the chain's finality.
+func (p *Pipeline) Target(ctx context.Context) (head, target uint64, err error) {
+	head, err = p.Client.GetBlockNumber(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error getting block number: %w", err)
+	}
+	target, err = p.Finality.Finalized(ctx, head)
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s finality: %w", p.Finality.Name(), err)
+	}
+	target = min(target, head)
+	p.Metrics.FinalityLag(p.Finality.Name(), head-target)
+	return head, target, nil
+}
+
+// finalize processes the finalized head fh. An error means fh must be retried.
+func (p *Pipeline) finalize(ctx context.Context, fh heads.Header) error {
+	client, srv, reorgMgr := p.Client, p.Service, p.Reorg
+
+	// retractions a reorg replay couldn't publish go out before the chain moves on
+	if _, err := backfill.FinishRetraction(ctx, srv, reorgMgr); err != nil {
+		return fmt.Errorf("pending retractions: %w", err)
+	}
+
+	// fetch the block the finalizer settled on
+	blk, err := client.GetBlockByHash(ctx, fh.Hash, true)
+	if err != nil {
+		return fmt.Errorf("get block by hash %v (%s): %w", fh.Number, fh.Hash, err)
+	}
+	if reorgMgr.ParentOK(blk) {
+		// normal path; the checkpoint only moves once every event is delivered
+		matches, err := srv.ProcessBlock(ctx, blk, false)
+		if err != nil {
+			return err
+		}
+		p.Metrics.IncBlocksProcessed()
+		p.Metrics.AddTxsMatched(matches)
+		p.Metrics.SetFinalized(blk.Number)
+		reorgMgr.Record(blk)
+		p.save(ctx, blk.Number)
+		p.logf("finalized block=%d txs=%d matches=%d", blk.Number, len(blk.Txs), matches)
+		return nil
+	}
+
+	// reorg path
+	p.logf("[REORG] parent mismatch at block %d (parent=%s)", blk.Number, blk.ParentHash)
+	return p.replayReorg(ctx, blk)
+}
+
+// replayReorg replays a reorg whose new chain ends at blk, checkpointing every
+// re-processed block.
+func (p *Pipeline) replayReorg(ctx context.Context, blk rpc.Block) error {
+	return backfill.ReplayReorg(ctx, p.Client, p.Service, p.Reorg, blk, func(n uint64) { p.save(ctx, n) })
+}
+
+// reconcile compares the checkpointed block n with the chain. If a reorg replaced
+// it while the watcher was down, the reorg is replayed before resuming. A replay
+// stopped before its retractions went out is finished.
+func (p *Pipeline) reconcile(ctx context.Context, n uint64) error {
+	if hash, ok := p.Reorg.Hash(n); ok {
+		blk, err := p.Client.GetBlockByNumber(ctx, n, true)
+		if err != nil {
+			return fmt.Errorf("get block by number %v: %w", n, err)
+		}
+		if blk.Hash != hash {
+			p.logf("[REORG] checkpointed block %d was %s, chain now has %s", n, hash, blk.Hash)
+			return p.replayReorg(ctx, blk)
+		}
+	}
+
+	r := p.Reorg.Retracting
+	if r == nil {
+		return nil
+	}
+	if n < r.Through {
+		p.logf("[REORG] resuming interrupted replay at %d, %d events pending retraction", n+1, len(r.Events))
+		save := func(m uint64) { p.save(ctx, m) }
+		if err := backfill.Run(ctx, p.Client, p.Service, p.Reorg, n+1, r.Through, p.Conf.BackfillWorkers, save); err != nil {
+			return err
+		}
+	}
+	if _, err := backfill.FinishRetraction(ctx, p.Service, p.Reorg); err != nil {
+		return err
+	}
+	p.save(ctx, p.finalized)
+	return nil
+}
+
+// save checkpoints block n together with the reorg window.
+func (p *Pipeline) save(ctx context.Context, n uint64) {
+	p.finalized = n
+	_ = p.Store.Save(ctx, checkpoint.State{
+		LastFinalized:      n,
+		UpdatedAt:          time.Now(),
+		Window:             p.Reorg.Window(),
+		DeepReorg:          p.Reorg.LastDeep,
+		PendingRetractions: p.Reorg.Retracting,
+	})
+}
@@ -0,0 +1,66 @@
+package e2e
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ARK21/deblock/internal/app/filter"
+	"github.com/ARK21/deblock/internal/app/users"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/stretchr/testify/require"
+
+	wmk "github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+)
+
+func TestKafkaSource_CatchUpAndLiveUpdates(t *testing.T) {
+	brokers := os.Getenv("KAFKA_BROKERS")
+	if brokers == "" {
+		t.Skip("set KAFKA_BROKERS to run this test (e.g., 127.0.0.1:9092)")
+	}
+	topic := "address_registry_" + watermill.NewShortUUID()
+	a := "0x000000000000000000000000000000000000dEaD"
+	b := "0x000000000000000000000000000000000000bEEF"
+
+	// the address is the Kafka key
+	pub, err := wmk.NewPublisher(wmk.PublisherConfig{
+		Brokers: []string{brokers},
+		Marshaler: wmk.NewWithPartitioningMarshaler(func(_ string, msg *message.Message) (string, error) {
+			return msg.Metadata.Get("address"), nil
+		}),
+	}, watermill.NewStdLogger(false, false))
+	require.NoError(t, err)
+	defer pub.Close()
+	put := func(addr string, rec *users.AddressRecord) {
+		var payload []byte
+		if rec != nil {
+			payload, _ = json.Marshal(rec)
+		}
+		msg := message.NewMessage(watermill.NewUUID(), payload)
+		msg.Metadata.Set("address", addr)
+		require.NoError(t, pub.Publish(topic, msg))
+	}
+	put(a, &users.AddressRecord{UserID: "u1"})
+	put(b, &users.AddressRecord{UserID: "u2"})
+	put(b, nil) // tombstone
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	src := users.NewKafkaSource([]string{brokers}, topic)
+	m, err := src.Load(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, m.Len())
+
+	live := filter.NewLive(m)
+	go src.Watch(ctx, live)
+	put(b, &users.AddressRecord{UserID: "u3"})
+
+	require.Eventually(t, func() bool {
+		e, ok := live.Current().Lookup(b)
+		return ok && e.UserID == "u3"
+	}, 10*time.Second, 50*time.Millisecond)
+}